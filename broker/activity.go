@@ -0,0 +1,53 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keeps track of the requests being served, so that those interrupted
+// by a shutdown can be reported.
+type activity struct {
+	mu     sync.Mutex
+	next   int
+	active map[int]string
+}
+
+func newActivity() *activity {
+	return &activity{active: make(map[int]string)}
+}
+
+func (a *activity) begin(desc string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next++
+	a.active[a.next] = desc + " (started at " + time.Now().Format(time.RFC3339) + ")"
+	return a.next
+}
+
+func (a *activity) end(id int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.active, id)
+}
+
+// Returns the descriptions of the requests still being served, in the order they were started.
+func (a *activity) list() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ids := make([]int, 0, len(a.active))
+	for id := range a.active {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	descs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		descs = append(descs, a.active[id])
+	}
+	return descs
+}
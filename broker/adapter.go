@@ -0,0 +1,61 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+)
+
+// Adapts a BrokerService to the ContextBrokerService. The contexts are
+// ignored, so the operations run to completion regardless of deadlines.
+// The optional interfaces implemented by the BrokerService are still honored.
+func Adapt(bs BrokerService) ContextBrokerService {
+	return &brokerServiceAdapter{bs}
+}
+
+type brokerServiceAdapter struct {
+	bs BrokerService
+}
+
+func (a *brokerServiceAdapter) Catalog(ctx context.Context) (Catalog, error) {
+	return a.bs.Catalog()
+}
+
+func (a *brokerServiceAdapter) Provision(ctx context.Context, preq ProvisioningRequest) (ProvisioningResponse, error) {
+	return a.bs.Provision(preq)
+}
+
+func (a *brokerServiceAdapter) Update(ctx context.Context, ureq UpdateRequest) (OperationResponse, error) {
+	return a.bs.Update(ureq)
+}
+
+func (a *brokerServiceAdapter) Deprovision(ctx context.Context, preq ProvisioningRequest) error {
+	return a.bs.Deprovision(preq)
+}
+
+func (a *brokerServiceAdapter) Bind(ctx context.Context, breq BindingRequest) (BindingResponse, error) {
+	return a.bs.Bind(breq)
+}
+
+func (a *brokerServiceAdapter) Unbind(ctx context.Context, breq BindingRequest) (OperationResponse, error) {
+	return a.bs.Unbind(breq)
+}
+
+// Returns the Broker Service to look up the optional interfaces on.
+func capabilitiesOf(cbs ContextBrokerService) interface{} {
+	if a, ok := cbs.(*brokerServiceAdapter); ok {
+		return a.bs
+	}
+	return cbs
+}
+
+// Returns the Broker Service offering the service to look up the optional
+// interfaces on, following the routes of nested composite Broker Services.
+func capabilitiesFor(capabilities interface{}, serviceId string) interface{} {
+	if r, ok := capabilities.(CapabilityRouter); ok {
+		return capabilitiesFor(r.CapabilitiesFor(serviceId), serviceId)
+	}
+	return capabilities
+}
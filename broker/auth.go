@@ -0,0 +1,119 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval to check the credentials file for changes at.
+const credentialsCheckInterval = 5 * time.Second
+
+type credential struct {
+	username string
+	password string
+}
+
+// Verifies Basic auth credentials either against the single configured
+// username/password pair, or against the pairs listed in a credentials file.
+// The file is re-read once it changes, so that the password used by
+// the Cloud Controller can be rotated without downtime.
+type authenticator struct {
+	static  credential
+	file    string
+	watcher *FileWatcher
+
+	mu    sync.RWMutex
+	creds []credential
+}
+
+func newAuthenticator(o Options) (*authenticator, error) {
+	a := &authenticator{static: credential{o.Username, o.Password}, file: o.CredentialsFile}
+	if a.file != "" {
+		watcher, err := NewFileWatcher(credentialsCheckInterval, a.load, a.file)
+		if err != nil {
+			return nil, err
+		}
+		a.watcher = watcher
+	}
+	return a, nil
+}
+
+func (a *authenticator) authenticate(username, password string) bool {
+	creds := a.credentials()
+	match := 0
+	for _, c := range creds {
+		// Do not short-circuit, so the time taken does not reveal which pair matched.
+		u := subtle.ConstantTimeCompare([]byte(username), []byte(c.username))
+		p := subtle.ConstantTimeCompare([]byte(password), []byte(c.password))
+		match |= u & p
+	}
+	return match == 1
+}
+
+func (a *authenticator) credentials() []credential {
+	if a.file == "" {
+		return []credential{a.static}
+	}
+	if err := a.watcher.Check(); err != nil {
+		slog.Warn("Keeping previous credentials", "component", "authenticator", "error", err)
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.creds
+}
+
+func (a *authenticator) load() error {
+	creds, err := readCredentials(a.file)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.creds = creds
+	a.mu.Unlock()
+
+	slog.Info("Credentials loaded", "component", "authenticator", "file", a.file, "pairs", len(creds))
+	return nil
+}
+
+// Reads 'username:password' pairs, one per line. Blank lines and lines
+// starting with '#' are ignored.
+func readCredentials(file string) ([]credential, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := []credential{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.SplitN(line, ":", 2)
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid credentials in [%v] at line [%v]", file, n))
+		}
+		creds = append(creds, credential{tokens[0], tokens[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(creds) == 0 {
+		return nil, errors.New(fmt.Sprintf("No credentials found in: [%v]", file))
+	}
+	return creds, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes the credentials file, moving its modification time forward,
+// so the change is detected regardless of the file system resolution.
+func writeCredentials(t *testing.T, file, content string, modified time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write credentials: %v", err)
+	}
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatalf("Unable to touch credentials: %v", err)
+	}
+}
+
+func TestAuthenticationChallengesClient(t *testing.T) {
+	h := newTestBroker(t, newFakeService("s1", "p1"))
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		status   int
+	}{
+		{"missing credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "admin", "wrong", http.StatusUnauthorized},
+		{"wrong username", "root", "secret", http.StatusUnauthorized},
+		{"valid credentials", "admin", "secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		req.Header.Set("X-Broker-Api-Version", MaxApiVersion.String())
+		if test.username != "" {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%v: expected %v, got %v", test.name, test.status, rec.Code)
+		}
+		challenge := rec.Header().Get("WWW-Authenticate")
+		if test.status == http.StatusUnauthorized && !strings.HasPrefix(challenge, "Basic realm=") {
+			t.Errorf("%v: expected a Basic auth challenge, got %q", test.name, challenge)
+		}
+	}
+}
+
+func TestCredentialsFileIsRotated(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials")
+	modified := time.Now()
+	writeCredentials(t, file, "# Cloud Controller\ncc:one\n\nops:ops\n", modified)
+
+	a, err := newAuthenticator(Options{CredentialsFile: file})
+	if err != nil {
+		t.Fatalf("Unable to load credentials: %v", err)
+	}
+	if !a.authenticate("cc", "one") || !a.authenticate("ops", "ops") {
+		t.Fatalf("Expected the credentials from the file to be accepted")
+	}
+
+	a.watcher.interval = time.Hour
+
+	// Changes are picked up only once the check interval elapsed
+	modified = modified.Add(time.Minute)
+	writeCredentials(t, file, "cc:two\n", modified)
+	if !a.authenticate("cc", "one") || a.authenticate("cc", "two") {
+		t.Errorf("Expected the file not to be checked within the interval")
+	}
+
+	a.watcher.interval = 0
+	if a.authenticate("cc", "one") || !a.authenticate("cc", "two") {
+		t.Errorf("Expected the rotated credentials to be accepted only")
+	}
+
+	// Invalid or missing files keep the previous credentials in place
+	modified = modified.Add(time.Minute)
+	writeCredentials(t, file, "cc\n", modified)
+	if !a.authenticate("cc", "two") {
+		t.Errorf("Expected the previous credentials to be kept when the file is invalid")
+	}
+	os.Remove(file)
+	if !a.authenticate("cc", "two") {
+		t.Errorf("Expected the previous credentials to be kept when the file is missing")
+	}
+}
+
+func TestInvalidCredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"missing password", "cc:\n", "Invalid credentials"},
+		{"missing separator", "# comment\ncc\n", "at line [2]"},
+		{"no credentials", "# comment\n\n", "No credentials found"},
+	}
+	for _, test := range tests {
+		file := filepath.Join(dir, "credentials")
+		writeCredentials(t, file, test.content, time.Now())
+		_, err := newAuthenticator(Options{CredentialsFile: file})
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected error containing %q, got %v", test.name, test.expected, err)
+		}
+	}
+
+	if _, err := newAuthenticator(Options{CredentialsFile: filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("Expected a missing credentials file to be rejected")
+	}
+}
@@ -5,38 +5,166 @@
 package broker
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 )
 
-type broker struct {
-	opts   Options
-	router *router
+// The Broker serves the Service Broker API on behalf of a Broker Service.
+// It either runs its own server, see Start, or is embedded into another
+// server as a http.Handler, see Handler and Mount.
+type Broker struct {
+	opts    Options
+	service ContextBrokerService
+	router  *router
+	tls     *tlsReloader
 }
 
-func New(o Options, bs BrokerService) *broker {
-	return &broker{o, newRouter(o, newHandler(bs))}
+func New(o Options, bs ContextBrokerService) (*Broker, error) {
+	auth, err := newAuthenticator(o)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newStateStore(o.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	var reloader *tlsReloader
+	if o.TLSCertFile != "" || o.TLSKeyFile != "" {
+		if reloader, err = newTLSReloader(o); err != nil {
+			return nil, err
+		}
+	}
+	return &Broker{o, bs, newRouter(o, auth, newHandler(o, bs, store)), reloader}, nil
+}
+
+// Registers middleware wrapping the Service Broker API routes. Middleware runs
+// in the order registered, once the request has passed the version check,
+// authentication and originating identity extraction. It must be registered
+// before the broker starts serving.
+func (b *Broker) Use(mw ...Middleware) {
+	b.router.use(mw...)
+}
+
+// Replaces the built-in Basic authentication against the configured
+// credentials with the given middleware.
+func (b *Broker) ReplaceAuthentication(mw Middleware) {
+	b.router.replaceAuthentication(mw)
 }
 
-func (b *broker) Start() {
+// Returns the handler serving the Service Broker API routes as well as
+// the metrics, health and readiness endpoints. The metrics require the same
+// authentication as the routes, the probes none.
+func (b *Broker) Handler() http.Handler {
+	return b.router
+}
+
+// Mounts the broker's handler under the given prefix, e.g. "/broker",
+// so that the catalog is served at "/broker/v2/catalog".
+func (b *Broker) Mount(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, b.router))
+}
+
+func (b *Broker) Start() {
+	if b.opts.PidFile != "" {
+		if err := writePidFile(b.opts.PidFile); err != nil {
+			slog.Error("Unable to write PID file", "component", "broker", "file", b.opts.PidFile, "error", err)
+		} else {
+			defer os.Remove(b.opts.PidFile)
+		}
+	}
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	addr := fmt.Sprintf("%v:%v", b.opts.Host, b.opts.Port)
+	server := &http.Server{Addr: addr, Handler: b.router}
 
 	errCh := make(chan error, 1)
 	go func() {
-		addr := fmt.Sprintf("%v:%v", b.opts.Host, b.opts.Port)
-		log.Printf("Broker started: Listening at [%v]", addr)
-		errCh <- http.ListenAndServe(addr, b.router)
+		if b.tls != nil {
+			server.TLSConfig = b.tls.serverConfig()
+			slog.Info("Broker started", "component", "broker", "address", addr, "tls", true)
+			errCh <- server.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Broker started", "component", "broker", "address", addr, "tls", false)
+			errCh <- server.ListenAndServe()
+		}
 	}()
 
-	select {
-	case err := <-errCh:
-		log.Printf("Broker shutdown with error: %v", err)
-	case sig := <-sigCh:
-		var _ = sig
-		log.Print("Broker shutdown gracefully")
+	// Certificates and the configuration of the Broker Service are reloaded
+	// on SIGHUP, which is left alone if there is nothing to reload.
+	_, reloadable := capabilitiesOf(b.service).(Reloader)
+	var hupCh chan os.Signal
+	if b.tls != nil || reloadable {
+		hupCh = make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+	}
+
+	for {
+		select {
+		case err := <-errCh:
+			slog.Error("Broker shutdown with error", "component", "broker", "error", err)
+			return
+		case <-hupCh:
+			b.reload()
+		case sig := <-sigCh:
+			slog.Info("Broker shutting down, draining requests", "component", "broker", "signal", sig.String(), "timeout", b.opts.ShutdownTimeout)
+			b.shutdown(server)
+			return
+		}
+	}
+}
+
+// Reloads the certificates and the configuration of the Broker Service,
+// keeping the previous ones if invalid.
+func (b *Broker) reload() {
+	if b.tls != nil {
+		if err := b.tls.watcher.Reload(); err != nil {
+			slog.Warn("Keeping previous certificates", "component", "broker", "error", err)
+		}
+	}
+	if r, ok := capabilitiesOf(b.service).(Reloader); ok {
+		if err := r.Reload(context.Background()); err != nil {
+			slog.Warn("Keeping previous configuration", "component", "broker", "error", err)
+		}
+	}
+}
+
+// Stops accepting new requests and waits for the active ones as well as
+// the asynchronous operations of the Broker Service to complete, reporting
+// those still running once the shutdown timeout expires. Each of the two
+// waits is given the full timeout, so that slow requests do not leave
+// the asynchronous operations without any time to complete.
+func (b *Broker) shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.opts.ShutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	for _, op := range b.router.activity.list() {
+		slog.Warn("Operation interrupted", "component", "broker", "request", op)
+	}
+
+	if d, ok := capabilitiesOf(b.service).(Drainer); ok {
+		drainCtx, cancel := context.WithTimeout(context.Background(), b.opts.ShutdownTimeout)
+		defer cancel()
+
+		slog.Info("Waiting for asynchronous operations", "component", "broker")
+		for _, op := range d.Drain(drainCtx) {
+			slog.Warn("Asynchronous operation interrupted", "component", "broker", "async_operation", op)
+		}
+	}
+
+	if err != nil {
+		slog.Error("Broker shutdown with error", "component", "broker", "error", err)
+		return
 	}
+	slog.Info("Broker shutdown gracefully", "component", "broker")
 }
@@ -0,0 +1,65 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Records the state of the context the operations are drained within.
+type drainingService struct {
+	*fakeService
+	drainErr chan error
+}
+
+func (s drainingService) Drain(ctx context.Context) []string {
+	s.drainErr <- ctx.Err()
+	return nil
+}
+
+func TestBrokerReloadsService(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	b, err := New(Options{Username: "admin", Password: "secret"}, fs)
+	if err != nil {
+		t.Fatalf("Unable to create broker: %v", err)
+	}
+	b.reload()
+	if calls := fs.recorded(); !reflect.DeepEqual(calls, []string{"Reload"}) {
+		t.Errorf("Expected the Broker Service to be reloaded, got calls %v", calls)
+	}
+}
+
+func TestShutdownGivesDrainItsOwnDeadline(t *testing.T) {
+	ds := drainingService{newFakeService("s1", "p1"), make(chan error, 1)}
+	b, err := New(Options{Username: "admin", Password: "secret", ShutdownTimeout: 50 * time.Millisecond}, ds)
+	if err != nil {
+		t.Fatalf("Unable to create broker: %v", err)
+	}
+
+	// A request outliving the shutdown timeout spends the deadline of the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})}
+	go server.Serve(l)
+	go http.Get("http://" + l.Addr().String())
+	<-entered
+
+	b.shutdown(server)
+	if err := <-ds.drainErr; err != nil {
+		t.Errorf("Expected the operations to be drained within a live context, got %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type compositeError struct {
+	code int
+	err  error
+}
+
+func (e *compositeError) Code() int {
+	return e.code
+}
+func (e *compositeError) Error() string {
+	return e.err.Error()
+}
+
+// Broker Service composed of several backends, each offering its own services.
+// The catalogs of the backends are merged and the requests dispatched to the
+// backend offering the requested service.
+type compositeService struct {
+	backends []ContextBrokerService
+
+	mu        sync.RWMutex
+	routes    map[string]ContextBrokerService // Backends by service ID
+	refreshed time.Time
+}
+
+// Minimum interval between the refreshes of the routes caused by requests
+// for unknown services.
+const routeRefreshInterval = 10 * time.Second
+
+// Composes the given Broker Services into one. Fails if their catalogs
+// cannot be retrieved or share any service or plan IDs.
+func NewComposite(ctx context.Context, backends ...ContextBrokerService) (ContextBrokerService, error) {
+	c := &compositeService{backends: backends}
+	if _, err := c.Catalog(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Merges the catalogs of the backends and refreshes the routes to them.
+func (c *compositeService) Catalog(ctx context.Context) (Catalog, error) {
+	var merged Catalog
+	routes := make(map[string]ContextBrokerService)
+	plans := make(map[string]string)
+	var duplicates []string
+
+	for _, backend := range c.backends {
+		cat, err := backend.Catalog(ctx)
+		if err != nil {
+			return Catalog{}, err
+		}
+		for _, s := range cat.Services {
+			if _, found := routes[s.Id]; found {
+				duplicates = append(duplicates, fmt.Sprintf("service [%v]", s.Id))
+			}
+			routes[s.Id] = backend
+			for _, p := range s.Plans {
+				if sid, found := plans[p.Id]; found {
+					duplicates = append(duplicates, fmt.Sprintf("plan [%v] of services [%v] and [%v]", p.Id, sid, s.Id))
+				}
+				plans[p.Id] = s.Id
+			}
+			merged.Services = append(merged.Services, s)
+		}
+	}
+	if len(duplicates) > 0 {
+		msg := fmt.Sprintf("Duplicate IDs in the catalogs: %v", strings.Join(duplicates, ", "))
+		return Catalog{}, &compositeError{ErrCodeOther, errors.New(msg)}
+	}
+
+	c.mu.Lock()
+	c.routes, c.refreshed = routes, time.Now()
+	c.mu.Unlock()
+
+	return merged, nil
+}
+
+// Returns the backend offering the service, refreshing the routes
+// in case the service has been added to a catalog since. The refreshes
+// are rate limited, so unknown services do not hit all the backends.
+func (c *compositeService) route(ctx context.Context, serviceId string) (ContextBrokerService, error) {
+	if backend := c.backendOf(serviceId); backend != nil {
+		return backend, nil
+	}
+	if c.refreshDue() {
+		if _, err := c.Catalog(ctx); err != nil {
+			return nil, err
+		}
+		if backend := c.backendOf(serviceId); backend != nil {
+			return backend, nil
+		}
+	}
+	msg := fmt.Sprintf("Unknown service_id: [%v]", serviceId)
+	return nil, &compositeError{ErrCodeBadRequest, errors.New(msg)}
+}
+
+func (c *compositeService) backendOf(serviceId string) ContextBrokerService {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.routes[serviceId]
+}
+
+func (c *compositeService) refreshDue() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.refreshed) < routeRefreshInterval {
+		return false
+	}
+	c.refreshed = time.Now()
+	return true
+}
+
+// Returns the backend offering the service to look up the optional interfaces on.
+func (c *compositeService) CapabilitiesFor(serviceId string) interface{} {
+	if backend := c.backendOf(serviceId); backend != nil {
+		return capabilitiesOf(backend)
+	}
+	return nil
+}
+
+func (c *compositeService) Provision(ctx context.Context, preq ProvisioningRequest) (ProvisioningResponse, error) {
+	backend, err := c.route(ctx, preq.ServiceId)
+	if err != nil {
+		return ProvisioningResponse{}, err
+	}
+	return backend.Provision(ctx, preq)
+}
+
+func (c *compositeService) Update(ctx context.Context, ureq UpdateRequest) (OperationResponse, error) {
+	backend, err := c.route(ctx, ureq.ServiceId)
+	if err != nil {
+		return OperationResponse{}, err
+	}
+	return backend.Update(ctx, ureq)
+}
+
+func (c *compositeService) Deprovision(ctx context.Context, preq ProvisioningRequest) error {
+	backend, err := c.route(ctx, preq.ServiceId)
+	if err != nil {
+		return err
+	}
+	return backend.Deprovision(ctx, preq)
+}
+
+func (c *compositeService) Bind(ctx context.Context, breq BindingRequest) (BindingResponse, error) {
+	backend, err := c.route(ctx, breq.ServiceId)
+	if err != nil {
+		return BindingResponse{}, err
+	}
+	return backend.Bind(ctx, breq)
+}
+
+func (c *compositeService) Unbind(ctx context.Context, breq BindingRequest) (OperationResponse, error) {
+	backend, err := c.route(ctx, breq.ServiceId)
+	if err != nil {
+		return OperationResponse{}, err
+	}
+	return backend.Unbind(ctx, breq)
+}
+
+// Checks the health of all the backends able to do so.
+func (c *compositeService) CheckHealth(ctx context.Context) error {
+	for _, backend := range c.backends {
+		if checker, ok := capabilitiesOf(backend).(HealthChecker); ok {
+			if err := checker.CheckHealth(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Waits for the asynchronous operations of all the backends running any.
+func (c *compositeService) Drain(ctx context.Context) []string {
+	var pending []string
+	for _, backend := range c.backends {
+		if d, ok := capabilitiesOf(backend).(Drainer); ok {
+			pending = append(pending, d.Drain(ctx)...)
+		}
+	}
+	return pending
+}
+
+// Reloads the configuration of all the backends able to do so, returning
+// the first error encountered.
+func (c *compositeService) Reload(ctx context.Context) error {
+	var first error
+	for _, backend := range c.backends {
+		if r, ok := capabilitiesOf(backend).(Reloader); ok {
+			if err := r.Reload(ctx); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,168 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Hides the optional interfaces of the wrapped Broker Service.
+type syncService struct {
+	ContextBrokerService
+}
+
+func TestCompositeRejectsDuplicateIds(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends []ContextBrokerService
+		expected string
+	}{
+		{"service", []ContextBrokerService{newFakeService("s1", "p1"), newFakeService("s1", "p2")}, "service [s1]"},
+		{"plan", []ContextBrokerService{newFakeService("s1", "p1"), newFakeService("s2", "p1")}, "plan [p1] of services [s1] and [s2]"},
+	}
+	for _, test := range tests {
+		_, err := NewComposite(context.Background(), test.backends...)
+		if err == nil {
+			t.Errorf("%v: expected duplicate IDs to be rejected", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected error mentioning %q, got %q", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestCompositeMergesCatalogs(t *testing.T) {
+	c, err := NewComposite(context.Background(), newFakeService("s1", "p1"), newFakeService("s2", "p2"))
+	if err != nil {
+		t.Fatalf("Unable to compose: %v", err)
+	}
+	cat, err := c.Catalog(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to retrieve catalog: %v", err)
+	}
+	if len(cat.Services) != 2 || cat.Services[0].Id != "s1" || cat.Services[1].Id != "s2" {
+		t.Errorf("Expected services s1 and s2, got %+v", cat.Services)
+	}
+}
+
+func TestCompositeRoutesByServiceId(t *testing.T) {
+	fs1, fs2 := newFakeService("s1", "p1"), newFakeService("s2", "p2")
+	c, err := NewComposite(context.Background(), fs1, fs2)
+	if err != nil {
+		t.Fatalf("Unable to compose: %v", err)
+	}
+	h := newTestBroker(t, c)
+
+	body := `{"service_id":"s2","plan_id":"p2","organization_guid":"org","space_guid":"space"}`
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1", body); status != http.StatusCreated {
+		t.Fatalf("provision: expected 201, got %v", status)
+	}
+	if calls := fs1.recorded(); len(calls) != 0 {
+		t.Errorf("Expected no calls to the s1 backend, got %v", calls)
+	}
+	if calls := fs2.recorded(); len(calls) != 1 || calls[0] != "provision i1" {
+		t.Errorf("Expected provisioning by the s2 backend, got %v", calls)
+	}
+
+	// Deprovisioning carries the service ID in the query
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1?service_id=s2&plan_id=p2", ""); status != http.StatusOK {
+		t.Fatalf("deprovision: expected 200, got %v", status)
+	}
+	if calls := fs2.recorded(); len(calls) != 2 || calls[1] != "deprovision i1" {
+		t.Errorf("Expected deprovisioning by the s2 backend, got %v", calls)
+	}
+}
+
+func TestCompositeRateLimitsRefreshesForUnknownServices(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	c, err := NewComposite(context.Background(), fs)
+	if err != nil {
+		t.Fatalf("Unable to compose: %v", err)
+	}
+	served := fs.catalogsServed()
+
+	for i := 0; i < 3; i++ {
+		err := c.Deprovision(context.Background(), ProvisioningRequest{InstanceId: "i1", ServiceId: "unknown"})
+		if se, ok := err.(BrokerServiceError); !ok || se.Code() != ErrCodeBadRequest {
+			t.Fatalf("Expected a bad request error for an unknown service, got %v", err)
+		}
+	}
+	if n := fs.catalogsServed() - served; n != 0 {
+		t.Errorf("Expected no refresh right after composing, got %v", n)
+	}
+
+	// Once the interval elapsed, a single refresh is made
+	c.(*compositeService).refreshed = time.Now().Add(-routeRefreshInterval)
+	for i := 0; i < 3; i++ {
+		c.Deprovision(context.Background(), ProvisioningRequest{InstanceId: "i1", ServiceId: "unknown"})
+	}
+	if n := fs.catalogsServed() - served; n != 1 {
+		t.Errorf("Expected a single refresh once the interval elapsed, got %v", n)
+	}
+}
+
+func TestCompositeExposesCapabilitiesOfBackends(t *testing.T) {
+	fs1, fs2, fs3 := newFakeService("s1", "p1"), newFakeService("s2", "p2"), newFakeService("s3", "p3")
+	nested, err := NewComposite(context.Background(), fs1)
+	if err != nil {
+		t.Fatalf("Unable to compose: %v", err)
+	}
+	c, err := NewComposite(context.Background(), nested, syncService{fs2}, fs3)
+	if err != nil {
+		t.Fatalf("Unable to compose: %v", err)
+	}
+
+	tests := []struct {
+		serviceId string
+		async     bool
+	}{
+		{"s1", true},
+		{"s2", false},
+		{"s3", true},
+		{"unknown", false},
+	}
+	for _, test := range tests {
+		_, async := capabilitiesFor(c, test.serviceId).(AsyncBrokerService)
+		if async != test.async {
+			t.Errorf("%v: expected asynchronous operations supported: %v, got %v", test.serviceId, test.async, async)
+		}
+	}
+
+	h := newTestBroker(t, c)
+	for _, test := range tests[:3] {
+		body := `{"service_id":"` + test.serviceId + `","plan_id":"p` + test.serviceId[1:] + `","organization_guid":"org","space_guid":"space"}`
+		status, _ := serve(h, "PUT", "/v2/service_instances/i-"+test.serviceId+"?accepts_incomplete=true", body)
+		if expected := map[bool]int{true: http.StatusAccepted, false: http.StatusCreated}[test.async]; status != expected {
+			t.Errorf("%v: expected provisioning to respond %v, got %v", test.serviceId, expected, status)
+		}
+	}
+}
+
+func TestCompositeReloadsBackends(t *testing.T) {
+	fs1, fs2, fs3 := newFakeService("s1", "p1"), newFakeService("s2", "p2"), newFakeService("s3", "p3")
+	fs1.err = errors.New("Invalid configuration")
+	c, err := NewComposite(context.Background(), fs1, syncService{fs2}, fs3)
+	if err != nil {
+		t.Fatalf("Unable to compose: %v", err)
+	}
+
+	if err := c.(Reloader).Reload(context.Background()); err != fs1.err {
+		t.Errorf("Expected the error of the first backend, got %v", err)
+	}
+	for _, test := range []struct {
+		fs       *fakeService
+		reloaded bool
+	}{{fs1, true}, {fs2, false}, {fs3, true}} {
+		if reloaded := len(test.fs.recorded()) == 1; reloaded != test.reloaded {
+			t.Errorf("%v: expected reloaded: %v, got calls %v", test.fs.serviceId, test.reloaded, test.fs.recorded())
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Upper limit of the request body size, well above any legitimate request.
+const maxBodySize = 1 << 20
+
+// Raised if the request body cannot be decoded or lacks mandatory data.
+type decodingError struct {
+	status int
+	value  BrokerError
+}
+
+func (e *decodingError) Error() string {
+	if len(e.value.Fields) > 0 {
+		fields := make([]string, 0, len(e.value.Fields))
+		for _, f := range e.value.Fields {
+			fields = append(fields, f.Field)
+		}
+		return fmt.Sprintf("%v: %v", e.value.Description, strings.Join(fields, ", "))
+	}
+	return e.value.Description
+}
+
+func malformedRequest(msg string) *decodingError {
+	return &decodingError{http.StatusBadRequest, BrokerError{Error: ErrorBadRequest, Description: msg}}
+}
+
+// Decodes the JSON request body into v, rejecting bodies exceeding the
+// size limit, malformed JSON, fields unknown to v and missing required fields.
+// The top-level fields are decoded one by one, so that the unknown ones are
+// detected in the same pass.
+func decodeRequest(req *http.Request, v interface{}, required ...string) error {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	if err != nil {
+		return malformedRequest(fmt.Sprintf("Unable to read request body: %v", err))
+	}
+	if len(body) > maxBodySize {
+		return malformedRequest(fmt.Sprintf("Request body exceeds %v bytes", maxBodySize))
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return malformedRequest("Missing request body")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return malformedRequest("Malformed request body: JSON object expected")
+	}
+
+	target := reflect.ValueOf(v).Elem()
+	known := jsonFields(target.Type())
+	var unknown []FieldError
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return malformedRequest(fmt.Sprintf("Malformed request body: %v", err))
+		}
+		name := tok.(string)
+
+		index, found := known[name]
+		if !found {
+			unknown = append(unknown, FieldError{name, "Unknown field"})
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return malformedRequest(fmt.Sprintf("Malformed request body: %v", err))
+			}
+			continue
+		}
+		if err := dec.Decode(target.FieldByIndex(index).Addr().Interface()); err != nil {
+			return malformedRequest(fmt.Sprintf("Malformed field [%v]: %v", name, err))
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return malformedRequest(fmt.Sprintf("Malformed request body: %v", err))
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return malformedRequest("Malformed request body: unexpected data after JSON object")
+	}
+
+	if len(unknown) > 0 {
+		sort.Sort(byField(unknown))
+		return &decodingError{http.StatusBadRequest, BrokerError{Error: ErrorBadRequest, Description: "Unknown fields", Fields: unknown}}
+	}
+
+	var missing []FieldError
+	for _, name := range required {
+		if index, found := known[name]; !found || target.FieldByIndex(index).IsZero() {
+			missing = append(missing, FieldError{name, "Required field"})
+		}
+	}
+	if len(missing) > 0 {
+		return &decodingError{http.StatusBadRequest, BrokerError{Error: ErrorBadRequest, Description: "Missing required fields", Fields: missing}}
+	}
+	return nil
+}
+
+// Returns the indexes of the JSON fields of the struct type by their names.
+func jsonFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for name, index := range jsonFields(f.Type) {
+				fields[name] = append([]int{i}, index...)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = []int{i}
+	}
+	return fields
+}
+
+type byField []FieldError
+
+func (s byField) Len() int           { return len(s) }
+func (s byField) Less(i, j int) bool { return s[i].Field < s[j].Field }
+func (s byField) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
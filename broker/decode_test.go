@@ -0,0 +1,95 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type decodedEmbedded struct {
+	Embedded string `json:"embedded"`
+}
+
+type decoded struct {
+	decodedEmbedded
+	Id       string                 `json:"id"`
+	Count    int                    `json:"count,omitempty"`
+	Params   map[string]interface{} `json:"params"`
+	Ignored  string                 `json:"-"`
+	internal string
+}
+
+func TestDecodeRequest(t *testing.T) {
+	oversized := `{"id":"i1","params":{"blob":"` + strings.Repeat("x", maxBodySize) + `"}}`
+
+	tests := []struct {
+		name     string
+		body     string
+		required []string
+		expected decoded
+		err      string
+		fields   []FieldError
+	}{
+		{"valid", `{"id":"i1","count":2,"embedded":"e","params":{"a":"b"}}`, []string{"id", "embedded"}, decoded{decodedEmbedded{"e"}, "i1", 2, map[string]interface{}{"a": "b"}, "", ""}, "", nil},
+		{"surrounding whitespace", " \n{\"id\":\"i1\"}\n", nil, decoded{Id: "i1"}, "", nil},
+		{"oversized", oversized, nil, decoded{}, "Request body exceeds 1048576 bytes", nil},
+		{"empty", "  ", nil, decoded{}, "Missing request body", nil},
+		{"not an object", `["id"]`, nil, decoded{}, "Malformed request body: JSON object expected", nil},
+		{"truncated", `{"id":"i1"`, nil, decoded{}, "Malformed request body", nil},
+		{"malformed field", `{"id":1}`, nil, decoded{}, "Malformed field [id]", nil},
+		{"trailing object", `{"id":"i1"}{"id":"i2"}`, nil, decoded{}, "unexpected data after JSON object", nil},
+		{"trailing garbage", `{"id":"i1"} x`, nil, decoded{}, "unexpected data after JSON object", nil},
+		{"unknown fields", `{"id":"i1","zone":"z","Ignored":"x","internal":"x"}`, nil, decoded{}, "Unknown fields",
+			[]FieldError{{"Ignored", "Unknown field"}, {"internal", "Unknown field"}, {"zone", "Unknown field"}}},
+		{"nested unknown fields", `{"id":"i1","params":{"zone":"z"}}`, nil, decoded{Id: "i1", Params: map[string]interface{}{"zone": "z"}}, "", nil},
+		{"missing fields", `{"count":1}`, []string{"id", "embedded"}, decoded{}, "Missing required fields",
+			[]FieldError{{"id", "Required field"}, {"embedded", "Required field"}}},
+		{"empty required field", `{"id":"","embedded":"e"}`, []string{"id", "embedded"}, decoded{}, "Missing required fields",
+			[]FieldError{{"id", "Required field"}}},
+	}
+	for _, test := range tests {
+		var v decoded
+		req := httptest.NewRequest("PUT", "/", strings.NewReader(test.body))
+		err := decodeRequest(req, &v, test.required...)
+
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.name, err)
+			} else if !reflect.DeepEqual(v, test.expected) {
+				t.Errorf("%v: expected %+v, got %+v", test.name, test.expected, v)
+			}
+			continue
+		}
+
+		de, ok := err.(*decodingError)
+		if !ok {
+			t.Errorf("%v: expected a decoding error, got %v", test.name, err)
+			continue
+		}
+		if de.status != http.StatusBadRequest || de.value.Error != ErrorBadRequest || !strings.Contains(de.value.Description, test.err) {
+			t.Errorf("%v: expected %q, got %v %+v", test.name, test.err, de.status, de.value)
+		}
+		if !reflect.DeepEqual(de.value.Fields, test.fields) {
+			t.Errorf("%v: expected fields %v, got %v", test.name, test.fields, de.value.Fields)
+		}
+	}
+}
+
+func TestDecodeRequestAcceptsBodyOfMaximumSize(t *testing.T) {
+	prefix, suffix := `{"id":"i1","params":{"blob":"`, `"}}`
+	body := prefix + strings.Repeat("x", maxBodySize-len(prefix)-len(suffix)) + suffix
+
+	var v decoded
+	if err := decodeRequest(httptest.NewRequest("PUT", "/", strings.NewReader(body)), &v, "id"); err != nil {
+		t.Errorf("Expected the body of %v bytes to be accepted, got %v", len(body), err)
+	}
+	if err := decodeRequest(httptest.NewRequest("PUT", "/", strings.NewReader(body+" ")), &v, "id"); err == nil {
+		t.Errorf("Expected the body of %v bytes to be rejected", len(body)+1)
+	}
+}
@@ -5,130 +5,756 @@
 package broker
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"github.com/gorilla/mux"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
 var empty struct{} = struct{}{}
 
 type handler struct {
-	brokerService BrokerService
+	opts          Options
+	brokerService ContextBrokerService
+	capabilities  interface{} // Implements the optional interfaces, if any
+	store         *stateStore
+	locks         *instanceLocks
 }
 
-func newHandler(bs BrokerService) *handler {
-	return &handler{bs}
+func newHandler(o Options, bs ContextBrokerService, s *stateStore) *handler {
+	return &handler{o, bs, capabilitiesOf(bs), s, newInstanceLocks()}
 }
 
-func (h *handler) catalog(r *http.Request) responseEntity {
+// Derives the context of a Broker Service operation from the request, so it
+// is cancelled once the operation's deadline expires or the client goes away.
+func (h *handler) operationContext(req *http.Request, operation string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), h.opts.timeoutOf(operation))
+}
+
+func (h *handler) catalog(req *http.Request) responseEntity {
+	log := loggerOf(req).With("operation", "catalog")
 
-	log.Printf("Handler: Requesting catalog")
+	log.Info("Requesting catalog")
 
-	if cat, err := h.brokerService.Catalog(); err != nil {
-		return handleServiceError(err)
+	ctx, cancel := h.operationContext(req, "catalog")
+	defer cancel()
+
+	if cat, err := h.brokerService.Catalog(ctx); err != nil {
+		return handleServiceError(log, err)
 	} else {
-		log.Printf("Handler: Catalog retrieved")
+		log.Info("Catalog retrieved")
+		h.warnRemovedPlans(log, cat)
 
 		return responseEntity{http.StatusOK, cat}
 	}
 }
 
+// Warns about plans removed from the catalog while service instances
+// of them still exist.
+func (h *handler) warnRemovedPlans(log *slog.Logger, cat Catalog) {
+	removed := make(map[string]int)
+	for _, is := range h.store.instances() {
+		if findPlan(cat, is.ServiceId, is.PlanId) == nil {
+			removed[bindingKey(is.ServiceId, is.PlanId)]++
+		}
+	}
+	for plan, count := range removed {
+		log.Warn("Plan removed from the catalog still has instances", "plan", plan, "instances", count)
+	}
+}
+
 func (h *handler) provision(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
-	preq := ProvisioningRequest{InstanceId: vars[instanceId]}
+	log := loggerOf(req).With("operation", "provision", "instance_id", vars[instanceId])
+	preq := ProvisioningRequest{
+		InstanceId:    vars[instanceId],
+		ApiVersion:    apiVersionOf(req),
+		Identity:      originatingIdentityOf(req),
+		RequestLogger: RequestLogger{log},
+	}
 
-	log.Printf("Handler: Provisioning: %v", preq)
+	log.Info("Provisioning")
 
-	if err := json.NewDecoder(req.Body).Decode(&preq); err != nil {
-		handleDecodingError(err)
+	ctx, cancel := h.operationContext(req, "provision")
+	defer cancel()
+
+	if err := decodeRequest(req, &preq, "service_id", "plan_id", "organization_guid", "space_guid"); err != nil {
+		return handleDecodingError(log, err)
 	}
+	preq.AcceptsIncomplete = h.acceptsIncomplete(req, preq.ServiceId)
+
+	log.Debug("Provisioning request decoded", "service_id", preq.ServiceId, "plan_id", preq.PlanId)
 
-	log.Printf("Handler: Provisioning request decoded: %v", preq)
+	if re, ok := h.validateParameters(ctx, log, preq.ServiceId, preq.PlanId, instanceCreateSchema, preq.Parameters); !ok {
+		return re
+	}
+
+	if is, found := h.store.instance(preq.InstanceId); found {
+		return provisionedAlready(log, preq, is)
+	}
 
-	url, err := h.brokerService.Provision(preq)
+	resp, err := h.brokerService.Provision(ctx, preq)
 	if err != nil {
-		return handleServiceError(err)
+		return handleServiceError(log, err)
 	}
 
-	log.Printf("Handler: Provisioned: %v", preq)
+	h.store.putInstance(preq.InstanceId, instanceState{
+		ServiceId:    preq.ServiceId,
+		PlanId:       preq.PlanId,
+		OrgId:        preq.OrgId,
+		SpaceId:      preq.SpaceId,
+		Context:      preq.Context,
+		DashboardUrl: resp.DashboardUrl,
+		Parameters:   preq.Parameters,
+		Operation:    resp.Operation,
+		Pending:      resp.Async,
+	})
+
+	if resp.Async {
+		log.Info("Provisioning in progress")
+
+		return responseEntity{http.StatusAccepted, resp}
+	}
+
+	log.Info("Provisioned")
 
-	return responseEntity{http.StatusCreated, struct {
-		DashboardUrl string `json:"dashboard_url"`
-	}{url}}
+	return responseEntity{http.StatusCreated, resp}
+}
+
+func (h *handler) update(req *http.Request) responseEntity {
+	vars := mux.Vars(req)
+	log := loggerOf(req).With("operation", "update", "instance_id", vars[instanceId])
+	ureq := UpdateRequest{
+		InstanceId:    vars[instanceId],
+		ApiVersion:    apiVersionOf(req),
+		Identity:      originatingIdentityOf(req),
+		RequestLogger: RequestLogger{log},
+	}
+
+	log.Info("Updating")
+
+	ctx, cancel := h.operationContext(req, "update")
+	defer cancel()
+
+	if re, busy := h.operationInProgress(log, ureq.InstanceId); busy {
+		return re
+	}
+
+	if err := decodeRequest(req, &ureq, "service_id"); err != nil {
+		return handleDecodingError(log, err)
+	}
+	ureq.AcceptsIncomplete = h.acceptsIncomplete(req, ureq.ServiceId)
+
+	// The plan is only sent when it is being changed, otherwise it is
+	// taken from the previous values or the recorded instance.
+	if ureq.PlanId == "" {
+		ureq.PlanId = ureq.PreviousValues.PlanId
+	}
+	if ureq.PlanId == "" {
+		is, _ := h.store.instance(ureq.InstanceId)
+		ureq.PlanId = is.PlanId
+	}
+
+	log.Debug("Update request decoded", "service_id", ureq.ServiceId, "plan_id", ureq.PlanId)
+
+	if re, ok := h.validateParameters(ctx, log, ureq.ServiceId, ureq.PlanId, instanceUpdateSchema, ureq.Parameters); !ok {
+		return re
+	}
+
+	resp, err := h.brokerService.Update(ctx, ureq)
+	if err != nil {
+		return handleServiceError(log, err)
+	}
+
+	is, _ := h.store.instance(ureq.InstanceId)
+	is.ServiceId = ureq.ServiceId
+	update := instanceUpdate{PlanId: ureq.PlanId, Parameters: ureq.Parameters}
+
+	if resp.Async {
+		// The changes are recorded once the Cloud Controller polls the update to success
+		is.Operation, is.Pending, is.Update = resp.Operation, true, &update
+		h.store.putInstance(ureq.InstanceId, is)
+
+		log.Info("Update in progress")
+
+		return responseEntity{http.StatusAccepted, resp}
+	}
+
+	is.apply(update)
+	h.store.putInstance(ureq.InstanceId, is)
+
+	log.Info("Updated")
+
+	return responseEntity{http.StatusOK, empty}
+}
+
+func (h *handler) fetchInstance(req *http.Request) responseEntity {
+	vars := mux.Vars(req)
+	log := loggerOf(req).With("operation", "fetch_instance", "instance_id", vars[instanceId])
+	preq := ProvisioningRequest{InstanceId: vars[instanceId], ApiVersion: apiVersionOf(req), Identity: originatingIdentityOf(req), RequestLogger: RequestLogger{log}}
+
+	log.Info("Fetching instance")
+
+	ctx, cancel := h.operationContext(req, "fetch_instance")
+	defer cancel()
+
+	is, found := h.store.instance(preq.InstanceId)
+	preq.ServiceId, preq.PlanId = is.ServiceId, is.PlanId
+
+	if ir, ok := h.capabilitiesFor(preq.ServiceId).(InstanceRetriever); ok {
+		resp, err := ir.FetchInstance(ctx, preq)
+		if err != nil {
+			return handleServiceError(log, err)
+		}
+
+		log.Info("Instance fetched")
+
+		return responseEntity{http.StatusOK, resp}
+	}
+
+	if found && is.Update != nil {
+		return concurrencyError(fmt.Sprintf("Update in progress for instance: [%v]", preq.InstanceId))
+	}
+	if !found || is.Pending {
+		return notFound("Service instance not found")
+	}
+
+	log.Info("Instance fetched")
+
+	return responseEntity{http.StatusOK, InstanceResponse{
+		ServiceId:    is.ServiceId,
+		PlanId:       is.PlanId,
+		DashboardUrl: is.DashboardUrl,
+		Parameters:   is.Parameters,
+	}}
+}
+
+func (h *handler) lastOperation(req *http.Request) responseEntity {
+	vars := mux.Vars(req)
+	log := loggerOf(req).With("operation", "last_operation", "instance_id", vars[instanceId])
+	query := req.URL.Query()
+	lreq := LastOperationRequest{
+		RequestLogger: RequestLogger{log},
+		InstanceId:    vars[instanceId],
+		ServiceId:     query.Get("service_id"),
+		PlanId:        query.Get("plan_id"),
+		Operation:     query.Get("operation"),
+	}
+
+	log.Info("Polling last operation")
+
+	ctx, cancel := h.operationContext(req, "last_operation")
+	defer cancel()
+
+	if is, found := h.store.instance(lreq.InstanceId); found && lreq.ServiceId == "" {
+		lreq.ServiceId, lreq.PlanId = is.ServiceId, is.PlanId
+	}
+
+	abs, ok := h.capabilitiesFor(lreq.ServiceId).(AsyncBrokerService)
+	if !ok {
+		return asyncNotSupported()
+	}
+
+	op, err := abs.LastOperation(ctx, lreq)
+	if err != nil {
+		return handleGoneServiceError(log, err)
+	}
+
+	if is, found := h.store.instance(lreq.InstanceId); found && is.Pending {
+		switch {
+		case op.State == OperationFailed && is.Update == nil:
+			h.store.removeInstance(lreq.InstanceId)
+		case op.State != OperationInProgress:
+			if op.State == OperationSucceeded && is.Update != nil {
+				is.apply(*is.Update)
+			}
+			is.Pending, is.Update = false, nil
+			h.store.putInstance(lreq.InstanceId, is)
+		}
+	}
+
+	log.Info("Last operation", "state", op.State)
+
+	return responseEntity{http.StatusOK, op}
 }
 
 func (h *handler) deprovision(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
-	preq := ProvisioningRequest{InstanceId: vars[instanceId]}
+	log := loggerOf(req).With("operation", "deprovision", "instance_id", vars[instanceId])
+	query := req.URL.Query()
+	preq := ProvisioningRequest{
+		InstanceId:    vars[instanceId],
+		ApiVersion:    apiVersionOf(req),
+		Identity:      originatingIdentityOf(req),
+		RequestLogger: RequestLogger{log},
+		ServiceId:     query.Get("service_id"),
+		PlanId:        query.Get("plan_id"),
+	}
+
+	log.Info("Deprovisioning")
+
+	ctx, cancel := h.operationContext(req, "deprovision")
+	defer cancel()
+
+	if re, busy := h.operationInProgress(log, preq.InstanceId); busy {
+		return re
+	}
 
-	log.Printf("Handler: Deprovisioning: %v", preq)
+	if re, ok := h.validateDeletedPlan(ctx, log, preq.InstanceId, preq.ServiceId, preq.PlanId); !ok {
+		return re
+	}
 
-	if err := h.brokerService.Deprovision(preq); err != nil {
-		return handleServiceError(err)
+	if err := h.brokerService.Deprovision(ctx, preq); err != nil {
+		return handleGoneServiceError(log, err)
 	}
 
-	log.Printf("Handler: Deprovisioned: %v", preq)
+	h.store.removeInstance(preq.InstanceId)
+
+	log.Info("Deprovisioned")
 
 	return responseEntity{http.StatusOK, empty}
 }
 
 func (h *handler) bind(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
-	breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId]}
+	log := loggerOf(req).With("operation", "bind", "instance_id", vars[instanceId], "binding_id", vars[bindingId])
+	breq := BindingRequest{
+		InstanceId:    vars[instanceId],
+		BindingId:     vars[bindingId],
+		ApiVersion:    apiVersionOf(req),
+		Identity:      originatingIdentityOf(req),
+		RequestLogger: RequestLogger{log},
+	}
+
+	log.Info("Binding")
+
+	ctx, cancel := h.operationContext(req, "bind")
+	defer cancel()
+
+	if err := decodeRequest(req, &breq, "service_id", "plan_id"); err != nil {
+		return handleDecodingError(log, err)
+	}
+	breq.AcceptsIncomplete = h.acceptsIncomplete(req, breq.ServiceId)
+
+	log.Debug("Binding request decoded", "service_id", breq.ServiceId, "plan_id", breq.PlanId)
 
-	log.Printf("Handler: Binding: %v", breq)
+	if bs, found := h.store.binding(breq.InstanceId, breq.BindingId); found {
+		return h.boundAlready(ctx, log, breq, bs)
+	}
 
-	if err := json.NewDecoder(req.Body).Decode(&breq); err != nil {
-		handleDecodingError(err)
+	if re, busy := h.operationInProgress(log, breq.InstanceId); busy {
+		return re
 	}
 
-	log.Printf("Handler: Binding request decoded: %v", breq)
+	if re, ok := h.validateParameters(ctx, log, breq.ServiceId, breq.PlanId, bindingCreateSchema, breq.Parameters); !ok {
+		return re
+	}
+
+	resp, err := h.brokerService.Bind(ctx, breq)
+	if err != nil {
+		return handleServiceError(log, err)
+	}
+
+	h.store.putBinding(breq.InstanceId, breq.BindingId, bindingState{
+		ServiceId:      breq.ServiceId,
+		PlanId:         breq.PlanId,
+		AppId:          breq.AppId,
+		BindResource:   breq.BindResource,
+		Context:        breq.Context,
+		Credentials:    resp.Credentials,
+		HasCredentials: resp.Credentials != nil,
+		SyslogDrainUrl: resp.SyslogDrainUrl,
+		Parameters:     breq.Parameters,
+		Operation:      resp.Operation,
+		Pending:        resp.Async,
+	})
+
+	if resp.Async {
+		log.Info("Binding in progress")
+
+		return responseEntity{http.StatusAccepted, resp}
+	}
+
+	log.Info("Bound")
+
+	return responseEntity{http.StatusCreated, resp}
+}
+
+func (h *handler) fetchBinding(req *http.Request) responseEntity {
+	vars := mux.Vars(req)
+	log := loggerOf(req).With("operation", "fetch_binding", "instance_id", vars[instanceId], "binding_id", vars[bindingId])
+	breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId], ApiVersion: apiVersionOf(req), Identity: originatingIdentityOf(req), RequestLogger: RequestLogger{log}}
+
+	log.Info("Fetching binding")
+
+	ctx, cancel := h.operationContext(req, "fetch_binding")
+	defer cancel()
+
+	bs, found := h.store.binding(breq.InstanceId, breq.BindingId)
+	breq.ServiceId, breq.PlanId = bs.ServiceId, bs.PlanId
+
+	_, retrievable := h.capabilitiesFor(breq.ServiceId).(BindingRetriever)
+	if !retrievable && (!found || bs.Pending) {
+		return notFound("Binding not found")
+	}
+	if !retrievable && bs.credentialsLost() {
+		log.Warn("Binding credentials lost")
+		return notFound("Binding credentials are no longer available")
+	}
 
-	cred, url, err := h.brokerService.Bind(breq)
+	resp, err := h.retrieveBinding(ctx, breq, bs)
 	if err != nil {
-		return handleServiceError(err)
+		return handleServiceError(log, err)
 	}
 
-	log.Printf("Handler: Bound: %v", breq)
+	log.Info("Binding fetched")
 
-	return responseEntity{http.StatusCreated, struct {
-		Credentials    interface{} `json:"credentials"`
-		SyslogDrainUrl string      `json:"syslog_drain_url "`
-	}{cred, url}}
+	return responseEntity{http.StatusOK, resp}
+}
+
+// Retrieves the binding from the Broker Service if possible, or returns
+// the recorded attributes otherwise.
+func (h *handler) retrieveBinding(ctx context.Context, breq BindingRequest, bs bindingState) (BindingResponse, error) {
+	if br, ok := h.capabilitiesFor(breq.ServiceId).(BindingRetriever); ok {
+		return br.FetchBinding(ctx, breq)
+	}
+	return BindingResponse{
+		Credentials:    bs.Credentials,
+		SyslogDrainUrl: bs.SyslogDrainUrl,
+		Parameters:     bs.Parameters,
+	}, nil
 }
 
 func (h *handler) unbind(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
-	breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId]}
+	log := loggerOf(req).With("operation", "unbind", "instance_id", vars[instanceId], "binding_id", vars[bindingId])
+	breq := BindingRequest{
+		InstanceId:        vars[instanceId],
+		BindingId:         vars[bindingId],
+		ApiVersion:        apiVersionOf(req),
+		AcceptsIncomplete: h.acceptsIncomplete(req, req.URL.Query().Get("service_id")),
+		Identity:          originatingIdentityOf(req),
+		RequestLogger:     RequestLogger{log},
+		ServiceId:         req.URL.Query().Get("service_id"),
+		PlanId:            req.URL.Query().Get("plan_id"),
+	}
+
+	log.Info("Unbinding")
+
+	ctx, cancel := h.operationContext(req, "unbind")
+	defer cancel()
+
+	bs, found := h.store.binding(breq.InstanceId, breq.BindingId)
+	if found && bs.Pending && bs.Unbinding {
+		log.Info("Unbinding still in progress")
 
-	log.Printf("Handler: Unbinding: %v", breq)
+		return responseEntity{http.StatusAccepted, OperationResponse{Operation: bs.Operation}}
+	}
+
+	if re, busy := h.operationInProgress(log, breq.InstanceId); busy {
+		return re
+	}
 
-	if err := h.brokerService.Unbind(breq); err != nil {
-		return handleServiceError(err)
+	if re, ok := h.validateDeletedPlan(ctx, log, breq.InstanceId, breq.ServiceId, breq.PlanId); !ok {
+		return re
 	}
 
-	log.Printf("Handler: Unbound: %v", breq)
+	resp, err := h.brokerService.Unbind(ctx, breq)
+	if err != nil {
+		return handleGoneServiceError(log, err)
+	}
+
+	if resp.Async {
+		// The binding is kept until the Cloud Controller polls the unbinding to completion
+		if found {
+			bs.Operation, bs.Pending, bs.Unbinding = resp.Operation, true, true
+			h.store.putBinding(breq.InstanceId, breq.BindingId, bs)
+		}
+
+		log.Info("Unbinding in progress")
+
+		return responseEntity{http.StatusAccepted, resp}
+	}
+
+	h.store.removeBinding(breq.InstanceId, breq.BindingId)
+
+	log.Info("Unbound")
 
 	return responseEntity{http.StatusOK, empty}
 }
 
-func handleDecodingError(err error) responseEntity {
-	log.Printf("Handler: Decoding error: %v", err)
-	return responseEntity{http.StatusBadRequest, BrokerError{err.Error()}}
+func (h *handler) bindingLastOperation(req *http.Request) responseEntity {
+	vars := mux.Vars(req)
+	log := loggerOf(req).With("operation", "binding_last_operation", "instance_id", vars[instanceId], "binding_id", vars[bindingId])
+	query := req.URL.Query()
+	lreq := LastOperationRequest{
+		RequestLogger: RequestLogger{log},
+		InstanceId:    vars[instanceId],
+		BindingId:     vars[bindingId],
+		ServiceId:     query.Get("service_id"),
+		PlanId:        query.Get("plan_id"),
+		Operation:     query.Get("operation"),
+	}
+
+	log.Info("Polling last binding operation")
+
+	ctx, cancel := h.operationContext(req, "binding_last_operation")
+	defer cancel()
+
+	if bs, found := h.store.binding(lreq.InstanceId, lreq.BindingId); found && lreq.ServiceId == "" {
+		lreq.ServiceId, lreq.PlanId = bs.ServiceId, bs.PlanId
+	}
+
+	abs, ok := h.capabilitiesFor(lreq.ServiceId).(AsyncBrokerService)
+	if !ok {
+		return asyncNotSupported()
+	}
+
+	op, err := abs.LastBindingOperation(ctx, lreq)
+	if err != nil {
+		return handleGoneServiceError(log, err)
+	}
+
+	if bs, found := h.store.binding(lreq.InstanceId, lreq.BindingId); found && bs.Pending {
+		switch {
+		case op.State == OperationSucceeded && bs.Unbinding,
+			op.State == OperationFailed && !bs.Unbinding:
+			h.store.removeBinding(lreq.InstanceId, lreq.BindingId)
+		case op.State != OperationInProgress:
+			bs.Pending, bs.Unbinding = false, false
+			h.store.putBinding(lreq.InstanceId, lreq.BindingId, bs)
+		}
+	}
+
+	log.Info("Last binding operation", "state", op.State)
+
+	return responseEntity{http.StatusOK, op}
+}
+
+// Responds to a provisioning request for an already recorded service instance,
+// so that retries of the Cloud Controller succeed.
+func provisionedAlready(log *slog.Logger, preq ProvisioningRequest, is instanceState) responseEntity {
+	if !is.matches(preq) {
+		log.Warn("Provisioning conflict")
+		return conflict("Service instance already exists with different attributes")
+	}
+
+	resp := ProvisioningResponse{DashboardUrl: is.DashboardUrl}
+	if is.Pending && is.Update == nil {
+		log.Info("Provisioning still in progress")
+
+		resp.Operation = is.Operation
+		return responseEntity{http.StatusAccepted, resp}
+	}
+
+	log.Info("Provisioned already")
+
+	return responseEntity{http.StatusOK, resp}
+}
+
+// Responds to a binding request for an already recorded binding,
+// so that retries of the Cloud Controller succeed.
+func (h *handler) boundAlready(ctx context.Context, log *slog.Logger, breq BindingRequest, bs bindingState) responseEntity {
+	if !bs.matches(breq) {
+		log.Warn("Binding conflict")
+		return conflict("Binding already exists with different attributes")
+	}
+
+	if bs.Pending {
+		log.Info("Binding still in progress")
+
+		return responseEntity{http.StatusAccepted, BindingResponse{Operation: bs.Operation}}
+	}
+
+	if _, ok := h.capabilitiesFor(breq.ServiceId).(BindingRetriever); !ok && bs.credentialsLost() {
+		log.Warn("Binding credentials lost")
+		return conflict("Binding already exists, but its credentials are no longer available")
+	}
+
+	resp, err := h.retrieveBinding(ctx, breq, bs)
+	if err != nil {
+		return handleServiceError(log, err)
+	}
+
+	log.Info("Bound already")
+
+	return responseEntity{http.StatusOK, resp}
+}
+
+// Rejects an operation while an asynchronous one is still in progress for
+// the instance or any of its bindings. This keeps the instance locked until
+// the Cloud Controller polls the asynchronous operation to completion.
+func (h *handler) operationInProgress(log *slog.Logger, iid string) (responseEntity, bool) {
+	if is, found := h.store.instance(iid); found && is.Pending {
+		log.Warn("Instance operation in progress", "pending_operation", is.Operation)
+		return concurrencyError(fmt.Sprintf("Operation in progress for instance: [%v]", iid)), true
+	}
+	if bid, bs, found := h.store.pendingBinding(iid); found {
+		log.Warn("Binding operation in progress", "pending_binding_id", bid, "pending_operation", bs.Operation)
+		return concurrencyError(fmt.Sprintf("Operation in progress for binding: [%v]", bid)), true
+	}
+	return responseEntity{}, false
 }
 
-func handleServiceError(err error) responseEntity {
-	log.Printf("Handler: Service error: %v", err)
+// Verifies the service and plan sent by the Cloud Controller are present
+// in the catalog and returns the plan. Returns false together with the error
+// response otherwise.
+func (h *handler) validatePlan(ctx context.Context, log *slog.Logger, serviceId, planId string) (*Plan, responseEntity, bool) {
+	if re, ok := requirePlan(serviceId, planId); !ok {
+		return nil, re, false
+	}
+
+	cat, err := h.brokerService.Catalog(ctx)
+	if err != nil {
+		return nil, handleServiceError(log, err), false
+	}
+	plan := findPlan(cat, serviceId, planId)
+	if plan == nil {
+		log.Warn("Unknown service or plan", "service_id", serviceId, "plan_id", planId)
+		return nil, badRequest(fmt.Sprintf("Unknown service_id: [%v] or plan_id: [%v]", serviceId, planId)), false
+	}
+	return plan, responseEntity{}, true
+}
 
-	switch err := err.(type) {
-	case BrokerServiceError:
-		switch err.Code() {
-		case ErrCodeConflict:
-			return responseEntity{http.StatusConflict, empty}
-		case ErrCodeGone:
-			return responseEntity{http.StatusGone, empty}
+// Verifies the service and plan are sent by the Cloud Controller.
+func requirePlan(serviceId, planId string) (responseEntity, bool) {
+	if serviceId == "" || planId == "" {
+		return badRequest("Missing service_id or plan_id"), false
+	}
+	return responseEntity{}, true
+}
+
+// Verifies the service and plan sent by the Cloud Controller to delete
+// an instance or one of its bindings. They have to match the ones recorded
+// for the instance, if any, and the catalog otherwise. Plans removed from
+// the catalog are accepted while instances of them are recorded, so that
+// they can still be deleted.
+func (h *handler) validateDeletedPlan(ctx context.Context, log *slog.Logger, iid, serviceId, planId string) (responseEntity, bool) {
+	if re, ok := requirePlan(serviceId, planId); !ok {
+		return re, false
+	}
+	if is, found := h.store.instance(iid); found {
+		if is.ServiceId != serviceId || is.PlanId != planId {
+			log.Warn("Service or plan not matching the instance", "service_id", serviceId, "plan_id", planId)
+			return badRequest(fmt.Sprintf("Unknown service_id: [%v] or plan_id: [%v] of instance: [%v]", serviceId, planId, iid)), false
 		}
+		return responseEntity{}, true
+	}
+	if h.store.planInUse(serviceId, planId) {
+		return responseEntity{}, true
+	}
+	_, re, ok := h.validatePlan(ctx, log, serviceId, planId)
+	return re, ok
+}
+
+// Validates the plan exists and the parameters conform to its schema before
+// they are passed to the Broker Service. Returns false together with the
+// error response if the plan or the parameters are invalid.
+func (h *handler) validateParameters(ctx context.Context, log *slog.Logger, serviceId, planId string, selector schemaSelector, params map[string]interface{}) (responseEntity, bool) {
+	plan, re, ok := h.validatePlan(ctx, log, serviceId, planId)
+	if !ok {
+		return re, false
+	}
+
+	errs, err := validateParameters(plan, selector, params)
+	if err != nil {
+		return handleServiceError(log, err), false
+	}
+	if len(errs) > 0 {
+		log.Warn("Invalid parameters", "errors", errs)
+		return responseEntity{http.StatusBadRequest, BrokerError{Description: "Invalid parameters", Fields: errs}}, false
+	}
+	return responseEntity{}, true
+}
+
+// Returns the optional interfaces implemented by the Broker Service offering
+// the service, which differ from service to service for composite ones.
+func (h *handler) capabilitiesFor(serviceId string) interface{} {
+	return capabilitiesFor(h.capabilities, serviceId)
+}
+
+// Incomplete operations are only accepted when both the Cloud Controller
+// and the Broker Service support them.
+func (h *handler) acceptsIncomplete(req *http.Request, serviceId string) bool {
+	if _, ok := h.capabilitiesFor(serviceId).(AsyncBrokerService); !ok {
+		return false
+	}
+	return req.URL.Query().Get("accepts_incomplete") == "true"
+}
+
+func asyncNotSupported() responseEntity {
+	return notFound("Asynchronous operations are not supported")
+}
+
+func conflict(msg string) responseEntity {
+	return responseEntity{http.StatusConflict, BrokerError{Error: ErrorConflict, Description: msg}}
+}
+
+func concurrencyError(msg string) responseEntity {
+	return responseEntity{http.StatusUnprocessableEntity, BrokerError{Error: ErrorConcurrency, Description: msg}}
+}
+
+func badRequest(msg string) responseEntity {
+	return responseEntity{http.StatusBadRequest, BrokerError{Error: ErrorBadRequest, Description: msg}}
+}
+
+func notFound(msg string) responseEntity {
+	return responseEntity{http.StatusNotFound, BrokerError{Error: ErrorNotFound, Description: msg}}
+}
+
+func handleDecodingError(log *slog.Logger, err error) responseEntity {
+	log.Warn("Decoding error", "error", err)
+	if err, ok := err.(*decodingError); ok {
+		return responseEntity{err.status, err.value}
+	}
+	return responseEntity{http.StatusBadRequest, BrokerError{Error: ErrorBadRequest, Description: err.Error()}}
+}
+
+// HTTP status and error code of the responses to Broker Service errors.
+var serviceErrorResponses = map[int]struct {
+	status int
+	error  string
+}{
+	ErrCodeConflict:                {http.StatusConflict, ErrorConflict},
+	ErrCodeGone:                    {http.StatusGone, ErrorGone},
+	ErrCodeNotFound:                {http.StatusNotFound, ErrorNotFound},
+	ErrCodeBadRequest:              {http.StatusBadRequest, ErrorBadRequest},
+	ErrCodeUnprocessableEntity:     {http.StatusUnprocessableEntity, ""},
+	ErrCodeAsyncRequired:           {http.StatusUnprocessableEntity, ErrorAsyncRequired},
+	ErrCodeRequiresApp:             {http.StatusUnprocessableEntity, ErrorRequiresApp},
+	ErrCodeMaintenanceInfoConflict: {http.StatusUnprocessableEntity, ErrorMaintenanceInfoConflict},
+	ErrCodeConcurrency:             {http.StatusUnprocessableEntity, ErrorConcurrency},
+	ErrCodeServiceUnavailable:      {http.StatusServiceUnavailable, ErrorServiceUnavailable},
+}
+
+// Like handleServiceError, but responds to gone entities with an empty body,
+// which the Cloud Controller expects when deleting or polling.
+func handleGoneServiceError(log *slog.Logger, err error) responseEntity {
+	if code := serviceErrorCode(err); code == ErrCodeGone {
+		log.Warn("Service error", "error", err, "code", code)
+		countServiceError(err)
+		return responseEntity{http.StatusGone, empty}
+	}
+	return handleServiceError(log, err)
+}
+
+// Responds to a Broker Service error. Its message is shown to the users
+// of the Cloud Controller, so the code is logged only.
+func handleServiceError(log *slog.Logger, err error) responseEntity {
+	code := serviceErrorCode(err)
+	log.Error("Service error", "error", err, "code", code)
+	countServiceError(err)
+
+	if r, found := serviceErrorResponses[code]; found {
+		return responseEntity{r.status, BrokerError{Error: r.error, Description: err.Error()}}
+	}
+	return responseEntity{http.StatusInternalServerError, BrokerError{Description: err.Error()}}
+}
+
+func serviceErrorCode(err error) int {
+	if err, ok := err.(BrokerServiceError); ok {
+		return err.Code()
 	}
-	return responseEntity{http.StatusInternalServerError, BrokerError{err.Error()}}
+	return ErrCodeOther
 }
@@ -0,0 +1,242 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestPlansRemovedFromCatalogCanBeDeleted(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	fs.complete(OperationSucceeded)
+	h := newTestBroker(t, fs)
+
+	serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+	serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1", bindBody)
+
+	// The plan is no longer offered by the service
+	fs.planId = "p2"
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i2", provisionBody); status != http.StatusBadRequest {
+		t.Errorf("provision: expected 400 for a removed plan, got %v", status)
+	}
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1/service_bindings/b1"+deleteQuery, ""); status != http.StatusOK {
+		t.Errorf("unbind: expected 200, got %v", status)
+	}
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, ""); status != http.StatusOK {
+		t.Errorf("deprovision: expected 200, got %v", status)
+	}
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1", ""); status != http.StatusBadRequest {
+		t.Errorf("deprovision: expected 400 without service_id and plan_id, got %v", status)
+	}
+}
+
+func TestDeletionsValidateServiceAndPlan(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	h := newTestBroker(t, fs)
+	serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"plan not matching the instance", "/v2/service_instances/i1?service_id=s1&plan_id=p2", http.StatusBadRequest},
+		{"service not matching the instance", "/v2/service_instances/i1/service_bindings/b1?service_id=s2&plan_id=p1", http.StatusBadRequest},
+		{"unknown plan", "/v2/service_instances/i2?service_id=s1&plan_id=p2", http.StatusBadRequest},
+		{"unknown service", "/v2/service_instances/i2/service_bindings/b1?service_id=s2&plan_id=p1", http.StatusBadRequest},
+		{"plan in the catalog", "/v2/service_instances/i2?service_id=s1&plan_id=p1", http.StatusOK},
+	}
+	for _, test := range tests {
+		if status, _ := serve(h, "DELETE", test.url, ""); status != test.status {
+			t.Errorf("%v: expected %v, got %v", test.name, test.status, status)
+		}
+	}
+
+	// Removed plans are accepted while instances of them are recorded
+	fs.planId = "p2"
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i3?service_id=s1&plan_id=p1", ""); status != http.StatusOK {
+		t.Errorf("removed plan in use: expected 200, got %v", status)
+	}
+	serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, "")
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i3?service_id=s1&plan_id=p1", ""); status != http.StatusBadRequest {
+		t.Errorf("removed plan no longer in use: expected 400, got %v", status)
+	}
+}
+
+func TestRepeatedProvisioningIsIdempotent(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	h := newTestBroker(t, fs)
+
+	body := `{"service_id":"s1","plan_id":"p1","organization_guid":"org","space_guid":"space","context":{"platform":"cloudfoundry","instance_name":"mq"},"parameters":{"a":1}}`
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1", body); status != http.StatusCreated {
+		t.Fatalf("provision: expected 201, got %v", status)
+	}
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1", body); status != http.StatusOK {
+		t.Errorf("repeated provision: expected 200, got %v", status)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"organization", `{"service_id":"s1","plan_id":"p1","organization_guid":"other","space_guid":"space","context":{"platform":"cloudfoundry","instance_name":"mq"},"parameters":{"a":1}}`},
+		{"space", `{"service_id":"s1","plan_id":"p1","organization_guid":"org","space_guid":"other","context":{"platform":"cloudfoundry","instance_name":"mq"},"parameters":{"a":1}}`},
+		{"context", `{"service_id":"s1","plan_id":"p1","organization_guid":"org","space_guid":"space","context":{"platform":"cloudfoundry","instance_name":"other"},"parameters":{"a":1}}`},
+		{"parameters", `{"service_id":"s1","plan_id":"p1","organization_guid":"org","space_guid":"space","context":{"platform":"cloudfoundry","instance_name":"mq"}}`},
+	}
+	for _, test := range tests {
+		status, be := serve(h, "PUT", "/v2/service_instances/i1", test.body)
+		if status != http.StatusConflict || be.Error != ErrorConflict {
+			t.Errorf("%v: expected 409 %v, got %v %q", test.name, ErrorConflict, status, be.Error)
+		}
+	}
+	if calls := fs.recorded(); len(calls) != 1 {
+		t.Errorf("Expected the repeated requests not to reach the service, got %v", calls)
+	}
+}
+
+func TestRepeatedAsyncProvisioningIsAccepted(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	h := newTestBroker(t, fs)
+
+	for i := 0; i < 2; i++ {
+		if status, _ := serve(h, "PUT", "/v2/service_instances/i1?accepts_incomplete=true", provisionBody); status != http.StatusAccepted {
+			t.Errorf("provision %v: expected 202, got %v", i, status)
+		}
+	}
+	if calls := fs.recorded(); len(calls) != 1 {
+		t.Errorf("Expected the repeated request not to reach the service, got %v", calls)
+	}
+}
+
+func TestRepeatedBindingIsIdempotent(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	h := newTestBroker(t, fs)
+	serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+
+	body := `{"service_id":"s1","plan_id":"p1","app_guid":"app","bind_resource":{"app_guid":"app"},"parameters":{"a":1}}`
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1", body); status != http.StatusCreated {
+		t.Fatalf("bind: expected 201, got %v", status)
+	}
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1", body); status != http.StatusOK {
+		t.Errorf("repeated bind: expected 200, got %v", status)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"plan", `{"service_id":"s1","plan_id":"p2","app_guid":"app","bind_resource":{"app_guid":"app"},"parameters":{"a":1}}`},
+		{"app", `{"service_id":"s1","plan_id":"p1","app_guid":"other","bind_resource":{"app_guid":"app"},"parameters":{"a":1}}`},
+		{"bind resource", `{"service_id":"s1","plan_id":"p1","app_guid":"app","bind_resource":{"app_guid":"other"},"parameters":{"a":1}}`},
+		{"route", `{"service_id":"s1","plan_id":"p1","app_guid":"app","bind_resource":{"app_guid":"app","route":"mq.example.com"},"parameters":{"a":1}}`},
+		{"context", `{"service_id":"s1","plan_id":"p1","app_guid":"app","bind_resource":{"app_guid":"app"},"context":{"platform":"cloudfoundry"},"parameters":{"a":1}}`},
+		{"parameters", `{"service_id":"s1","plan_id":"p1","app_guid":"app","bind_resource":{"app_guid":"app"},"parameters":{"a":2}}`},
+	}
+	for _, test := range tests {
+		status, be := serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1", test.body)
+		if status != http.StatusConflict || be.Error != ErrorConflict {
+			t.Errorf("%v: expected 409 %v, got %v %q", test.name, ErrorConflict, status, be.Error)
+		}
+	}
+	if calls := fs.recorded(); len(calls) != 2 {
+		t.Errorf("Expected the repeated requests not to reach the service, got %v", calls)
+	}
+}
+
+func TestServiceErrorsMapToStatuses(t *testing.T) {
+	tests := []struct {
+		code   int
+		status int
+		error  string
+	}{
+		{ErrCodeConflict, http.StatusConflict, ErrorConflict},
+		{ErrCodeGone, http.StatusGone, ErrorGone},
+		{ErrCodeNotFound, http.StatusNotFound, ErrorNotFound},
+		{ErrCodeBadRequest, http.StatusBadRequest, ErrorBadRequest},
+		{ErrCodeUnprocessableEntity, http.StatusUnprocessableEntity, ""},
+		{ErrCodeAsyncRequired, http.StatusUnprocessableEntity, ErrorAsyncRequired},
+		{ErrCodeRequiresApp, http.StatusUnprocessableEntity, ErrorRequiresApp},
+		{ErrCodeMaintenanceInfoConflict, http.StatusUnprocessableEntity, ErrorMaintenanceInfoConflict},
+		{ErrCodeConcurrency, http.StatusUnprocessableEntity, ErrorConcurrency},
+		{ErrCodeServiceUnavailable, http.StatusServiceUnavailable, ErrorServiceUnavailable},
+		{ErrCodeOther, http.StatusInternalServerError, ""},
+	}
+	for _, test := range tests {
+		fs := newFakeService("s1", "p1")
+		fs.err = &compositeError{test.code, errors.New("Service failed")}
+		h := newTestBroker(t, fs)
+
+		status, be := serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+		if status != test.status || be.Error != test.error || be.Description != "Service failed" {
+			t.Errorf("%v: expected %v %q, got %v %+v", test.code, test.status, test.error, status, be)
+		}
+	}
+
+	fs := newFakeService("s1", "p1")
+	fs.err = errors.New("Service failed")
+	if status, be := serve(newTestBroker(t, fs), "PUT", "/v2/service_instances/i1", provisionBody); status != http.StatusInternalServerError || be.Description != "Service failed" {
+		t.Errorf("Expected other errors to respond 500, got %v %+v", status, be)
+	}
+}
+
+func TestGoneEntitiesAreDeletedWithEmptyBody(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	h := newTestBroker(t, fs)
+	serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+	fs.err = &compositeError{ErrCodeGone, errors.New("Entity not found")}
+
+	for what, url := range map[string]string{
+		"unbind":      "/v2/service_instances/i1/service_bindings/b1" + deleteQuery,
+		"deprovision": "/v2/service_instances/i1" + deleteQuery,
+	} {
+		if status, be := serve(h, "DELETE", url, ""); status != http.StatusGone || be.Error != "" || be.Description != "" {
+			t.Errorf("%v: expected 410 with an empty body, got %v %+v", what, status, be)
+		}
+	}
+}
+
+func TestAsyncUpdateIsRecordedOnceSucceeded(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	fs.otherPlans = []string{"p2"}
+	h := newTestBroker(t, fs)
+	serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+
+	fetchPlan := func() string {
+		var ir InstanceResponse
+		if status := serveJson(h, "GET", "/v2/service_instances/i1", "", &ir); status != http.StatusOK {
+			t.Fatalf("fetch instance: expected 200, got %v", status)
+		}
+		return ir.PlanId
+	}
+	update := func() {
+		body := `{"service_id":"s1","plan_id":"p2"}`
+		if status, _ := serve(h, "PATCH", "/v2/service_instances/i1?accepts_incomplete=true", body); status != http.StatusAccepted {
+			t.Fatalf("update: expected 202, got %v", status)
+		}
+	}
+
+	update()
+	status, be := serve(h, "PATCH", "/v2/service_instances/i1?accepts_incomplete=true", `{"service_id":"s1","plan_id":"p2"}`)
+	expectConcurrencyError(t, "update", status, be)
+	status, be = serve(h, "GET", "/v2/service_instances/i1", "")
+	expectConcurrencyError(t, "fetch instance", status, be)
+
+	// A failed update keeps the instance on its previous plan
+	fs.complete(OperationFailed)
+	serve(h, "GET", "/v2/service_instances/i1/last_operation", "")
+	if plan := fetchPlan(); plan != "p1" {
+		t.Errorf("Expected the plan to be kept after a failed update, got %v", plan)
+	}
+
+	update()
+	fs.complete(OperationSucceeded)
+	serve(h, "GET", "/v2/service_instances/i1/last_operation", "")
+	if plan := fetchPlan(); plan != "p2" {
+		t.Errorf("Expected the plan to be changed after a successful update, got %v", plan)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"net/http"
+)
+
+const (
+	healthUrlPattern    = "/healthz"
+	readinessUrlPattern = "/readyz"
+)
+
+type healthStatus struct {
+	Status string `json:"status"`
+}
+
+// Reports the broker is alive as long as it is able to serve requests.
+func (h *handler) healthz(req *http.Request) responseEntity {
+	return responseEntity{http.StatusOK, healthStatus{"ok"}}
+}
+
+// Reports the broker is ready once its Broker Service passes the health check.
+func (h *handler) readyz(req *http.Request) responseEntity {
+	checker, ok := h.capabilities.(HealthChecker)
+	if !ok {
+		return responseEntity{http.StatusOK, healthStatus{"ok"}}
+	}
+
+	ctx, cancel := h.operationContext(req, "readyz")
+	defer cancel()
+
+	if err := checker.CheckHealth(ctx); err != nil {
+		loggerOf(req).Warn("Health check failed", "operation", "readyz", "error", err)
+		return responseEntity{http.StatusServiceUnavailable, BrokerError{Description: err.Error()}}
+	}
+	return responseEntity{http.StatusOK, healthStatus{"ok"}}
+}
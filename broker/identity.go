@@ -0,0 +1,75 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const originatingIdentityHeader = "X-Broker-Api-Originating-Identity"
+
+// Identity of the platform user that triggered the request, as sent by
+// the platform in the 'X-Broker-API-Originating-Identity' header.
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/profile.md#originating-identity-header
+type OriginatingIdentity struct {
+	Platform string
+	Value    map[string]interface{}
+}
+
+// Returns the ID of the user, as sent by the Cloud Foundry and Kubernetes platforms.
+func (i OriginatingIdentity) UserId() string {
+	for _, key := range []string{"user_id", "uid"} {
+		if id, ok := i.Value[key].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+func (i OriginatingIdentity) String() string {
+	if i.Platform == "" {
+		return "anonymous"
+	}
+	return fmt.Sprintf("%v/%v", i.Platform, i.UserId())
+}
+
+type originatingIdentityKey struct{}
+
+func withOriginatingIdentity(req *http.Request, i OriginatingIdentity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), originatingIdentityKey{}, i))
+}
+
+// Returns the originating identity sent along with the given request, if any.
+func originatingIdentityOf(req *http.Request) OriginatingIdentity {
+	i, _ := req.Context().Value(originatingIdentityKey{}).(OriginatingIdentity)
+	return i
+}
+
+// Parses the '<platform> <base64 encoded JSON>' header value.
+func extractOriginatingIdentity(req *http.Request) (OriginatingIdentity, error) {
+	header := req.Header.Get(originatingIdentityHeader)
+	if header == "" {
+		return OriginatingIdentity{}, nil
+	}
+	tokens := strings.Fields(header)
+	if len(tokens) != 2 {
+		return OriginatingIdentity{}, errors.New("Invalid originating identity")
+	}
+	raw, err := base64.StdEncoding.DecodeString(tokens[1])
+	if err != nil {
+		return OriginatingIdentity{}, errors.New("Unable to decode originating identity")
+	}
+	value := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return OriginatingIdentity{}, errors.New("Unable to decode originating identity")
+	}
+	return OriginatingIdentity{tokens[0], value}, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+)
+
+// Serializes the operations mutating a service instance or its bindings.
+type instanceLocks struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func newInstanceLocks() *instanceLocks {
+	return &instanceLocks{held: make(map[string]bool)}
+}
+
+// Acquires the lock of the instance unless it is held already.
+func (l *instanceLocks) tryLock(iid string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[iid] {
+		return false
+	}
+	l.held[iid] = true
+	return true
+}
+
+func (l *instanceLocks) unlock(iid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, iid)
+}
+
+// Wraps the handler of a mutating operation, rejecting it while another
+// one is being served for the same instance. Once an asynchronous operation
+// has been accepted, the instance stays locked by its pending state in
+// the store, see operationInProgress.
+func (h *handler) exclusive(fn reponseHandler) reponseHandler {
+	return func(req *http.Request) responseEntity {
+		iid := mux.Vars(req)[instanceId]
+		if !h.locks.tryLock(iid) {
+			loggerOf(req).Warn("Concurrent operation rejected", "instance_id", iid)
+			return concurrencyError(fmt.Sprintf("Another operation is being served for instance: [%v]", iid))
+		}
+		defer h.locks.unlock(iid)
+
+		return fn(req)
+	}
+}
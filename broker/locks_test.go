@@ -0,0 +1,118 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	provisionBody = `{"service_id":"s1","plan_id":"p1","organization_guid":"org","space_guid":"space"}`
+	bindBody      = `{"service_id":"s1","plan_id":"p1"}`
+	deleteQuery   = "?service_id=s1&plan_id=p1"
+)
+
+func expectConcurrencyError(t *testing.T, what string, status int, be BrokerError) {
+	t.Helper()
+	if status != http.StatusUnprocessableEntity || be.Error != ErrorConcurrency {
+		t.Errorf("%v: expected 422 %v, got %v %q", what, ErrorConcurrency, status, be.Error)
+	}
+}
+
+func TestOperationsServedConcurrentlyForInstanceAreRejected(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	fs.gate, fs.entered = make(chan struct{}), make(chan struct{})
+	h := newTestBroker(t, fs)
+
+	done := make(chan int)
+	go func() {
+		status, _ := serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+		done <- status
+	}()
+	<-fs.entered
+
+	status, be := serve(h, "PATCH", "/v2/service_instances/i1", `{"service_id":"s1"}`)
+	expectConcurrencyError(t, "update", status, be)
+	status, be = serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, "")
+	expectConcurrencyError(t, "deprovision", status, be)
+	status, be = serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1", bindBody)
+	expectConcurrencyError(t, "bind", status, be)
+
+	close(fs.gate)
+	if status := <-done; status != http.StatusCreated {
+		t.Errorf("provision: expected 201, got %v", status)
+	}
+	if calls := fs.recorded(); len(calls) != 1 {
+		t.Errorf("expected only the provisioning to reach the service, got %v", calls)
+	}
+
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, ""); status != http.StatusOK {
+		t.Errorf("deprovision: expected 200 once the lock is released, got %v", status)
+	}
+}
+
+func TestInstanceStaysLockedWhileBindingIsPending(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	h := newTestBroker(t, fs)
+
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1", provisionBody); status != http.StatusCreated {
+		t.Fatalf("provision: expected 201, got %v", status)
+	}
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1?accepts_incomplete=true", bindBody); status != http.StatusAccepted {
+		t.Fatalf("bind: expected 202, got %v", status)
+	}
+
+	// Retries of the pending binding are still answered
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1?accepts_incomplete=true", bindBody); status != http.StatusAccepted {
+		t.Errorf("bind retry: expected 202, got %v", status)
+	}
+
+	status, be := serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, "")
+	expectConcurrencyError(t, "deprovision", status, be)
+	status, be = serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b2", bindBody)
+	expectConcurrencyError(t, "bind", status, be)
+
+	fs.complete(OperationSucceeded)
+	if status, _ := serve(h, "GET", "/v2/service_instances/i1/service_bindings/b1/last_operation", ""); status != http.StatusOK {
+		t.Fatalf("binding last operation: expected 200, got %v", status)
+	}
+
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, ""); status != http.StatusOK {
+		t.Errorf("deprovision: expected 200 once the binding completed, got %v", status)
+	}
+}
+
+func TestInstanceStaysLockedWhileUnbindingIsPending(t *testing.T) {
+	fs := newFakeService("s1", "p1")
+	fs.complete(OperationSucceeded)
+	h := newTestBroker(t, fs)
+
+	serve(h, "PUT", "/v2/service_instances/i1", provisionBody)
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1", bindBody); status != http.StatusCreated {
+		t.Fatalf("bind: expected 201, got %v", status)
+	}
+
+	fs.complete(OperationInProgress)
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1/service_bindings/b1"+deleteQuery+"&accepts_incomplete=true", ""); status != http.StatusAccepted {
+		t.Fatalf("unbind: expected 202, got %v", status)
+	}
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1/service_bindings/b1"+deleteQuery+"&accepts_incomplete=true", ""); status != http.StatusAccepted {
+		t.Errorf("unbind retry: expected 202, got %v", status)
+	}
+
+	status, be := serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, "")
+	expectConcurrencyError(t, "deprovision", status, be)
+
+	fs.complete(OperationSucceeded)
+	serve(h, "GET", "/v2/service_instances/i1/service_bindings/b1/last_operation", "")
+
+	if status, _ := serve(h, "GET", "/v2/service_instances/i1/service_bindings/b1", ""); status != http.StatusNotFound {
+		t.Errorf("fetch binding: expected 404 once unbound, got %v", status)
+	}
+	if status, _ := serve(h, "DELETE", "/v2/service_instances/i1"+deleteQuery, ""); status != http.StatusOK {
+		t.Errorf("deprovision: expected 200 once the unbinding completed, got %v", status)
+	}
+}
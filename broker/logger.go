@@ -0,0 +1,163 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const logBackups = 5
+
+// Configures the default structured logger according to the options: lines
+// are written as JSON, debugging output is only enabled by -D and the output
+// is redirected to the -L file, rotated once it exceeds the configured size.
+// Secrets are redacted from the output in any case.
+func ConfigureLogging(o Options) error {
+	var out io.Writer = os.Stderr
+	if o.LogFile != "" {
+		f, err := newRotatingFile(o.LogFile, int64(o.LogMaxSize)*1024*1024, logBackups)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	level := slog.LevelInfo
+	if o.Debug {
+		level = slog.LevelDebug
+	}
+	handler := slog.NewJSONHandler(&redactingWriter{out}, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Carries the logger of a request, which annotates every line with the
+// request ID and the entities and operation the request refers to.
+// It is embedded into the requests passed to the Broker Service, so the
+// service can log in the same context.
+type RequestLogger struct {
+	logger *slog.Logger
+}
+
+// Returns the logger of the request.
+func (r RequestLogger) Log() *slog.Logger {
+	if r.logger == nil {
+		return slog.Default()
+	}
+	return r.logger
+}
+
+type loggerKey struct{}
+
+func withLogger(req *http.Request, l *slog.Logger) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), loggerKey{}, l))
+}
+
+// Returns the logger of the given request.
+func loggerOf(req *http.Request) *slog.Logger {
+	if l, ok := req.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// Takes the request ID from the headers set by the Cloud Controller
+// or the router in front of the broker, or generates a new one.
+func extractRequestId(req *http.Request) string {
+	for _, header := range []string{"X-Request-Id", "X-Broker-Api-Request-Identity"} {
+		if id := req.Header.Get(header); id != "" {
+			return id
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// A log file which is rotated once it exceeds its maximal size. The rotated
+// files are suffixed by .1, .2, ... with .1 being the most recent one.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file [%v]: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Moves the file to the first backup and starts a new one. The file is
+// reopened even if it cannot be moved, so the log keeps being appended to
+// and the rotation is retried by the next write.
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	if err == nil {
+		for i := f.backups - 1; i > 0; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		err = os.Rename(f.path, f.backup(1))
+	}
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
+
+// Writes the PID of the broker's process to the file.
+func writePidFile(file string) error {
+	return ioutil.WriteFile(file, []byte(strconv.Itoa(os.Getpid())), 0644)
+}
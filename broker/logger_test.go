@@ -0,0 +1,80 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readLog(t *testing.T, file string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Unable to read log: %v", err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	f, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer f.file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Unable to write log: %v", err)
+		}
+	}
+
+	expected := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for file, content := range expected {
+		if log := readLog(t, file); log != content {
+			t.Errorf("Expected %q in %v, got %q", content, file, log)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected no more than 2 backups to be kept")
+	}
+}
+
+func TestRotatingFileKeepsLoggingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	f, err := newRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer f.file.Close()
+
+	// A non-empty directory in place of the backup cannot be replaced
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0755); err != nil {
+		t.Fatalf("Unable to block the backup: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Unable to write log despite the failed rotation: %v", err)
+		}
+	}
+	if log := readLog(t, path); log != "first\nsecond\nthird\n" {
+		t.Errorf("Expected all the lines to be appended, got %q", log)
+	}
+
+	// The rotation is retried once possible
+	os.RemoveAll(path + ".1")
+	if _, err := f.Write([]byte("fourth\n")); err != nil {
+		t.Fatalf("Unable to write log: %v", err)
+	}
+	if log := readLog(t, path); log != "fourth\n" {
+		t.Errorf("Expected the log to be rotated, got %q", log)
+	}
+	if log := readLog(t, path+".1"); log != "first\nsecond\nthird\n" {
+		t.Errorf("Expected the rotated lines in the backup, got %q", log)
+	}
+}
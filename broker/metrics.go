@@ -0,0 +1,94 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const metricsUrlPattern = "/metrics"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "broker",
+		Name:      "requests_total",
+		Help:      "Number of Service Broker API requests by operation and status code.",
+	}, []string{"operation", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "broker",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of Service Broker API requests by operation and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "status"})
+
+	serviceErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "broker",
+		Name:      "service_errors_total",
+		Help:      "Number of errors returned by the broker service by error code.",
+	}, []string{"code"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, serviceErrorsTotal)
+}
+
+// Handler exposing the collected metrics in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+func observeRequest(operation string, status int, duration time.Duration) {
+	code := strconv.Itoa(status)
+	requestsTotal.WithLabelValues(operation, code).Inc()
+	requestDuration.WithLabelValues(operation, code).Observe(duration.Seconds())
+}
+
+// Captures the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func countServiceError(err error) {
+	serviceErrorsTotal.WithLabelValues(errCodeName(serviceErrorCode(err))).Inc()
+}
+
+func errCodeName(code int) string {
+	switch code {
+	case ErrCodeConflict:
+		return "conflict"
+	case ErrCodeGone:
+		return "gone"
+	case ErrCodeNotFound:
+		return "not_found"
+	case ErrCodeBadRequest:
+		return "bad_request"
+	case ErrCodeUnprocessableEntity:
+		return "unprocessable_entity"
+	case ErrCodeAsyncRequired:
+		return "async_required"
+	case ErrCodeRequiresApp:
+		return "requires_app"
+	case ErrCodeMaintenanceInfoConflict:
+		return "maintenance_info_conflict"
+	case ErrCodeConcurrency:
+		return "concurrency"
+	case ErrCodeServiceUnavailable:
+		return "service_unavailable"
+	case ErrCodeOther:
+		return "other"
+	}
+	return strconv.Itoa(code)
+}
@@ -5,7 +5,12 @@
 package broker
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 var Opts Options = Options{}
@@ -15,14 +20,23 @@ func init() {
 }
 
 type Options struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	Debug    bool
-	LogFile  string
-	Trace    bool
-	PidFile  string
+	Host              string
+	Port              int
+	Username          string
+	Password          string
+	CredentialsFile   string
+	StateFile         string
+	ShutdownTimeout   time.Duration
+	OperationTimeout  time.Duration
+	OperationTimeouts Timeouts
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSClientCAFile   string
+	Debug             bool
+	LogFile           string
+	LogMaxSize        int
+	Trace             bool
+	PidFile           string
 }
 
 func (o *Options) configure(fs *flag.FlagSet) {
@@ -38,10 +52,37 @@ func (o *Options) configure(fs *flag.FlagSet) {
 	fs.StringVar(&o.Password, "bp", "secret", "")
 	fs.StringVar(&o.Password, "broker-password", "secret", "")
 
+	fs.StringVar(&o.CredentialsFile, "bc", "", "")
+	fs.StringVar(&o.CredentialsFile, "broker-credentials", "", "")
+
+	fs.StringVar(&o.StateFile, "bs", "", "")
+	fs.StringVar(&o.StateFile, "broker-state", "", "")
+
+	fs.DurationVar(&o.ShutdownTimeout, "bt", 30*time.Second, "")
+	fs.DurationVar(&o.ShutdownTimeout, "broker-shutdown-timeout", 30*time.Second, "")
+
+	fs.DurationVar(&o.OperationTimeout, "bo", 60*time.Second, "")
+	fs.DurationVar(&o.OperationTimeout, "broker-timeout", 60*time.Second, "")
+
+	o.OperationTimeouts = make(Timeouts)
+	fs.Var(o.OperationTimeouts, "bot", "")
+	fs.Var(o.OperationTimeouts, "broker-timeouts", "")
+
+	fs.StringVar(&o.TLSCertFile, "btc", "", "")
+	fs.StringVar(&o.TLSCertFile, "broker-tls-cert", "", "")
+
+	fs.StringVar(&o.TLSKeyFile, "btk", "", "")
+	fs.StringVar(&o.TLSKeyFile, "broker-tls-key", "", "")
+
+	fs.StringVar(&o.TLSClientCAFile, "bta", "", "")
+	fs.StringVar(&o.TLSClientCAFile, "broker-tls-client-ca", "", "")
+
 	fs.BoolVar(&o.Debug, "D", false, "")
 
 	fs.StringVar(&o.LogFile, "L", "", "")
 
+	fs.IntVar(&o.LogMaxSize, "LM", 10, "")
+
 	fs.BoolVar(&o.Trace, "V", false, "")
 
 	fs.StringVar(&o.PidFile, "P", "", "")
@@ -53,8 +94,53 @@ Broker Options:
     -br, --port PORT                   Use PORT (default: 9999)
     -bu, --user USERNAME               User required to authenticate requests (default: admin)
     -bp, --pass PASSWORD               Password for the USERNAME user (default: secret)
+    -bc, --broker-credentials FILE     File with username:password pairs to authenticate against (reloaded on change)
+    -bs, --broker-state FILE           File to persist provisioned instances and bindings to (default: in memory)
+    -bt, --broker-shutdown-timeout DUR Time to wait for active requests, then for async operations, on shutdown (default: 30s)
+    -bo, --broker-timeout DUR          Deadline of the Broker Service operations (default: 60s)
+    -bot, --broker-timeouts LIST       Deadlines of individual operations, e.g. provision=2m,bind=30s
+    -btc, --broker-tls-cert FILE       Serve HTTPS using the certificate from FILE (reloaded on change or SIGHUP)
+    -btk, --broker-tls-key FILE        Private key for the TLS certificate
+    -bta, --broker-tls-client-ca FILE  Require client certificates signed by the CA bundle from FILE
     -D                                 Enable debugging output
     -L FILE                            File to redirect log output to
+    -LM SIZE                           Rotate the log FILE once it exceeds SIZE megabytes (default: 10)
     -V                                 Trace the incoming service broker's HTTP requests
     -P FILE                            File to store broker's PID to
 `
+
+// Returns the deadline of the given Broker Service operation.
+func (o Options) timeoutOf(operation string) time.Duration {
+	if d, found := o.OperationTimeouts[operation]; found {
+		return d
+	}
+	return o.OperationTimeout
+}
+
+// Deadlines of the Broker Service operations, parsed from a comma-separated
+// list of operation=duration pairs.
+type Timeouts map[string]time.Duration
+
+func (t Timeouts) String() string {
+	pairs := make([]string, 0, len(t))
+	for op, d := range t {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", op, d))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t Timeouts) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		tokens := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(tokens) != 2 || tokens[0] == "" {
+			return errors.New(fmt.Sprintf("Invalid operation timeout: [%v]", pair))
+		}
+		d, err := time.ParseDuration(tokens[1])
+		if err != nil {
+			return err
+		}
+		t[tokens[0]] = d
+	}
+	return nil
+}
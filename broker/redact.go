@@ -0,0 +1,60 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+)
+
+// Placeholder for secrets scrubbed from the log output.
+const Redacted = "[REDACTED]"
+
+var (
+	authHeaderPattern  = regexp.MustCompile(`(?i)((?:Proxy-)?Authorization:)[^\r\n\\"]*`)
+	uriPasswordPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]*:)[^@\s/]*@`)
+)
+
+// Scrubs authorization headers and passwords embedded in URIs from the text.
+func Redact(s string) string {
+	s = authHeaderPattern.ReplaceAllString(s, "$1 "+Redacted)
+	return uriPasswordPattern.ReplaceAllString(s, "${1}"+Redacted+"@")
+}
+
+// Hides the credential values, so that credentials never reach the log
+// when formatted.
+func (c Credentials) String() string {
+	return fmt.Sprint(c.redacted())
+}
+
+// Hides the credential values from structured log entries as well, which
+// are not formatted by String.
+func (c Credentials) LogValue() slog.Value {
+	return slog.AnyValue(c.redacted())
+}
+
+func (c Credentials) redacted() map[string]string {
+	redacted := make(map[string]string, len(c))
+	for k := range c {
+		redacted[k] = Redacted
+	}
+	return redacted
+}
+
+// Redacts everything written to the log, as a last line of defense
+// against leaking secrets. Works on JSON encoded lines as well, where
+// line breaks and quotes are escaped.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -10,11 +10,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -24,51 +25,191 @@ const (
 )
 
 var (
-	catalogUrlPattern      = fmt.Sprintf("/%v/catalog", apiVersion)
-	provisioningUrlPattern = fmt.Sprintf("/%v/service_instances/{%v}", apiVersion, instanceId)
-	bindingUrlPattern      = fmt.Sprintf("/%v/service_instances/{%v}/service_bindings/{%v}", apiVersion, instanceId, bindingId)
+	catalogUrlPattern              = fmt.Sprintf("/%v/catalog", apiVersion)
+	provisioningUrlPattern         = fmt.Sprintf("/%v/service_instances/{%v}", apiVersion, instanceId)
+	lastOperationUrlPattern        = fmt.Sprintf("/%v/service_instances/{%v}/last_operation", apiVersion, instanceId)
+	bindingUrlPattern              = fmt.Sprintf("/%v/service_instances/{%v}/service_bindings/{%v}", apiVersion, instanceId, bindingId)
+	bindingLastOperationUrlPattern = fmt.Sprintf("/%v/service_instances/{%v}/service_bindings/{%v}/last_operation", apiVersion, instanceId, bindingId)
 )
 
+// Middleware wraps a handler to perform additional processing of the requests,
+// such as authentication, tracing or rate limiting.
+type Middleware func(http.Handler) http.Handler
+
 type router struct {
-	opts Options
-	mux  *mux.Router // TODO: Replace with own simpler regexp-based mux???
+	opts           Options
+	auth           *authenticator
+	activity       *activity
+	public         map[string]http.Handler // Served without version check and authentication
+	metrics        http.Handler            // Served without version check
+	mux            *mux.Router             // TODO: Replace with own simpler regexp-based mux???
+	authentication Middleware
+	middleware     []Middleware
+	chain          http.Handler
 }
 
-func newRouter(o Options, h *handler) *router {
+func newRouter(o Options, a *authenticator, h *handler) *router {
 	mux := mux.NewRouter()
-	mux.Handle(catalogUrlPattern, reponseHandler(h.catalog)).Methods("GET")
-	mux.Handle(provisioningUrlPattern, reponseHandler(h.provision)).Methods("PUT")
-	mux.Handle(provisioningUrlPattern, reponseHandler(h.deprovision)).Methods("DELETE")
-	mux.Handle(bindingUrlPattern, reponseHandler(h.bind)).Methods("PUT")
-	mux.Handle(bindingUrlPattern, reponseHandler(h.unbind)).Methods("DELETE")
-	return &router{o, mux}
+	mux.Handle(catalogUrlPattern, reponseHandler(h.catalog)).Methods("GET").Name("catalog")
+	mux.Handle(provisioningUrlPattern, reponseHandler(h.fetchInstance)).Methods("GET").Name("fetch_instance")
+	mux.Handle(provisioningUrlPattern, h.exclusive(h.provision)).Methods("PUT").Name("provision")
+	mux.Handle(provisioningUrlPattern, h.exclusive(h.update)).Methods("PATCH").Name("update")
+	mux.Handle(provisioningUrlPattern, h.exclusive(h.deprovision)).Methods("DELETE").Name("deprovision")
+	mux.Handle(lastOperationUrlPattern, reponseHandler(h.lastOperation)).Methods("GET").Name("last_operation")
+	mux.Handle(bindingUrlPattern, h.exclusive(h.bind)).Methods("PUT").Name("bind")
+	mux.Handle(bindingUrlPattern, reponseHandler(h.fetchBinding)).Methods("GET").Name("fetch_binding")
+	mux.Handle(bindingUrlPattern, h.exclusive(h.unbind)).Methods("DELETE").Name("unbind")
+	mux.Handle(bindingLastOperationUrlPattern, reponseHandler(h.bindingLastOperation)).Methods("GET").Name("binding_last_operation")
+	public := map[string]http.Handler{
+		healthUrlPattern:    reponseHandler(h.healthz),
+		readinessUrlPattern: reponseHandler(h.readyz),
+	}
+	r := &router{opts: o, auth: a, activity: newActivity(), public: public, mux: mux}
+	r.authentication = r.authenticate
+	r.build()
+	return r
 }
 
-// Log & verify request and then pass it to Gorilla to be dispatched approprietly.
-func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if dump, err := httputil.DumpRequest(req, true); err != nil {
-		log.Printf("Cannot log incoming request: %v", err)
-	} else {
-		log.Print(string(dump))
+// Chains the built-in steps, followed by the registered middleware, around the routes.
+// The metrics require authentication too, as they reveal the broker's activity.
+func (r *router) build() {
+	r.metrics = r.authentication(metricsHandler())
+
+	steps := []Middleware{r.instrument, r.trace, r.checkVersion, r.authentication, r.extractIdentity, r.track}
+	steps = append(steps, r.middleware...)
+
+	var chain http.Handler = r.mux
+	for i := len(steps) - 1; i >= 0; i-- {
+		chain = steps[i](chain)
 	}
+	r.chain = chain
+}
 
-	major, minor, err := extractVersion(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+func (r *router) use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+	r.build()
+}
+
+func (r *router) replaceAuthentication(mw Middleware) {
+	r.authentication = mw
+	r.build()
+}
+
+// Correlate the request with its log entries and then pass it through the chain.
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	requestId := extractRequestId(req)
+	w.Header().Set("X-Request-Id", requestId)
+	log := slog.Default().With("request_id", requestId, "method", req.Method, "path", req.URL.Path)
+	req = withLogger(req, log)
+
+	// Probes are served to any client.
+	if h, ok := r.public[req.URL.Path]; ok {
+		h.ServeHTTP(w, req)
 		return
 	}
-	log.Printf("Router: Version check: [%v.%v]", major, minor)
-	//TODO: Verify compatibility
-
-	username, password, err := extractCredentials(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+	if req.URL.Path == metricsUrlPattern {
+		r.metrics.ServeHTTP(w, req)
 		return
 	}
-	log.Printf("Router: Authentication: [%v/%v]", username, password)
-	//TODO: Authenticate based on the opts object
 
-	r.mux.ServeHTTP(w, req)
+	r.chain.ServeHTTP(w, req)
+}
+
+// Records the outcome and latency of the request, including requests rejected
+// before reaching the route. Requests matching no route are recorded as such.
+func (r *router) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		operation := "unmatched"
+		var match mux.RouteMatch
+		if r.mux.Match(req, &match) && match.Route != nil {
+			operation = match.Route.GetName()
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, req)
+		observeRequest(operation, rec.status, time.Since(start))
+	})
+}
+
+func (r *router) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.opts.Trace {
+			if dump, err := httputil.DumpRequest(req, true); err != nil {
+				loggerOf(req).Warn("Cannot trace incoming request", "error", err)
+			} else {
+				loggerOf(req).Info("Incoming request", "dump", Redact(string(dump)))
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *router) checkVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := loggerOf(req)
+
+		version, err := extractVersion(req)
+		if err != nil {
+			writeResponse(w, responseEntity{http.StatusPreconditionFailed, BrokerError{Description: err.Error()}})
+			return
+		}
+		log.Debug("Version check", "version", version.String())
+		if !version.isSupported() {
+			msg := fmt.Sprintf("Unsupported Broker API version: [%v], supported: [%v] or any later [%v.x]", version, MinApiVersion, MaxApiVersion.Major)
+			log.Warn("Unsupported Broker API version", "version", version.String())
+			writeResponse(w, responseEntity{http.StatusPreconditionFailed, BrokerError{Description: msg}})
+			return
+		}
+		next.ServeHTTP(w, withApiVersion(req, version))
+	})
+}
+
+func (r *router) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := loggerOf(req)
+
+		username, password, err := extractCredentials(req)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+		log.Debug("Authentication", "username", username)
+		if !r.auth.authenticate(username, password) {
+			log.Warn("Authentication failed", "username", username)
+			unauthorized(w, errors.New("Invalid credentials"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *router) extractIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, err := extractOriginatingIdentity(req)
+		if err != nil {
+			writeResponse(w, responseEntity{http.StatusBadRequest, BrokerError{Description: err.Error()}})
+			return
+		}
+		loggerOf(req).Debug("Originating identity", "identity", identity.String())
+		next.ServeHTTP(w, withOriginatingIdentity(req, identity))
+	})
+}
+
+// Keeps track of the request while it is being served, see activity.
+func (r *router) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := r.activity.begin(fmt.Sprintf("%v %v", req.Method, req.URL.Path))
+		defer r.activity.end(id)
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Reject the request and challenge the client to authenticate using Basic auth.
+func unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="cf-service-broker"`)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
 }
 
 type responseEntity struct {
@@ -80,30 +221,33 @@ type reponseHandler func(*http.Request) responseEntity
 
 // Marshall the response entity as JSON and return the proper HTTP status code.
 func (fn reponseHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	re := fn(req)
+	writeResponse(w, fn(req))
+}
+
+func writeResponse(w http.ResponseWriter, re responseEntity) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(re.status)
 	if err := json.NewEncoder(w).Encode(re.value); err != nil {
-		log.Printf("Error occured while marshalling response entity: %v", err)
+		slog.Error("Error occured while marshalling response entity", "error", err)
 	}
 }
 
 // Helpers
-func extractVersion(req *http.Request) (int, int, error) {
+func extractVersion(req *http.Request) (ApiVersion, error) {
 	versions, _ := req.Header["X-Broker-Api-Version"]
 	if len(versions) != 1 {
-		return 0, 0, errors.New("Missing Broker API version")
+		return ApiVersion{}, errors.New("Missing Broker API version")
 	}
 	tokens := strings.Split(versions[0], ".")
 	if len(tokens) != 2 {
-		return 0, 0, errors.New("Invalid Broker API version")
+		return ApiVersion{}, errors.New("Invalid Broker API version")
 	}
 	major, err1 := strconv.Atoi(tokens[0])
 	minor, err2 := strconv.Atoi(tokens[1])
 	if err1 != nil || err2 != nil {
-		return 0, 0, errors.New("Invalid Broker API version")
+		return ApiVersion{}, errors.New("Invalid Broker API version")
 	}
-	return major, minor, nil
+	return ApiVersion{major, minor}, nil
 }
 
 func extractCredentials(req *http.Request) (string, string, error) {
@@ -119,7 +263,7 @@ func extractCredentials(req *http.Request) (string, string, error) {
 	if err != nil {
 		return "", "", errors.New("Unable to decode 'Authorization' header")
 	}
-	credentials := strings.Split(string(raw), ":")
+	credentials := strings.SplitN(string(raw), ":", 2)
 	if len(credentials) != 2 {
 		return "", "", errors.New("Missing credentials")
 	}
@@ -0,0 +1,289 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tenantKey struct{}
+
+// Records the contexts the optional interfaces are called with.
+type contextService struct {
+	*fakeService
+
+	mu       sync.Mutex
+	contexts map[string]context.Context
+}
+
+func newContextService() *contextService {
+	return &contextService{fakeService: newFakeService("s1", "p1"), contexts: make(map[string]context.Context)}
+}
+
+func (s *contextService) called(operation string, ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contexts[operation] = ctx
+}
+
+func (s *contextService) contextOf(operation string) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.contexts[operation]
+}
+
+func (s *contextService) FetchInstance(ctx context.Context, preq ProvisioningRequest) (InstanceResponse, error) {
+	s.called("fetch_instance", ctx)
+	return InstanceResponse{ServiceId: s.serviceId, PlanId: s.planId}, nil
+}
+
+func (s *contextService) FetchBinding(ctx context.Context, breq BindingRequest) (BindingResponse, error) {
+	s.called("fetch_binding", ctx)
+	return BindingResponse{}, nil
+}
+
+func (s *contextService) LastOperation(ctx context.Context, lreq LastOperationRequest) (LastOperation, error) {
+	s.called("last_operation", ctx)
+	return s.fakeService.LastOperation(ctx, lreq)
+}
+
+func (s *contextService) LastBindingOperation(ctx context.Context, lreq LastOperationRequest) (LastOperation, error) {
+	s.called("binding_last_operation", ctx)
+	return s.fakeService.LastOperation(ctx, lreq)
+}
+
+func (s *contextService) CheckHealth(ctx context.Context) error {
+	s.called("readyz", ctx)
+	return nil
+}
+
+// Passes the tenant header down the request context.
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tenantKey{}, req.Header.Get("X-Tenant"))))
+	})
+}
+
+func TestOptionalInterfacesReceiveRequestContext(t *testing.T) {
+	cs := newContextService()
+	timeouts := Timeouts{"fetch_instance": time.Minute, "fetch_binding": 2 * time.Minute, "readyz": 3 * time.Minute}
+	b, err := New(Options{Username: "admin", Password: "secret", OperationTimeout: time.Hour, OperationTimeouts: timeouts}, cs)
+	if err != nil {
+		t.Fatalf("Unable to create broker: %v", err)
+	}
+	b.Use(withTenant)
+	h := b.Handler()
+
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1", provisionBody); status != http.StatusCreated {
+		t.Fatalf("Expected the instance to be provisioned, got %v", status)
+	}
+	if status, _ := serve(h, "PUT", "/v2/service_instances/i1/service_bindings/b1", bindBody); status != http.StatusCreated {
+		t.Fatalf("Expected the binding to be created, got %v", status)
+	}
+
+	tests := []struct {
+		operation string
+		url       string
+		timeout   time.Duration
+		tenant    interface{}
+	}{
+		{"fetch_instance", "/v2/service_instances/i1", time.Minute, "t1"},
+		{"fetch_binding", "/v2/service_instances/i1/service_bindings/b1", 2 * time.Minute, "t1"},
+		{"last_operation", "/v2/service_instances/i1/last_operation", time.Hour, "t1"},
+		{"binding_last_operation", "/v2/service_instances/i1/service_bindings/b1/last_operation", time.Hour, "t1"},
+		// The probes are served without the middleware
+		{"readyz", "/readyz", 3 * time.Minute, nil},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("X-Broker-Api-Version", MaxApiVersion.String())
+		req.Header.Set("X-Tenant", "t1")
+		req.SetBasicAuth("admin", "secret")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		ctx := cs.contextOf(test.operation)
+		if ctx == nil {
+			t.Errorf("%v: expected the optional interface to be called", test.operation)
+			continue
+		}
+		deadline, ok := ctx.Deadline()
+		if remaining := time.Until(deadline); !ok || remaining > test.timeout || remaining < test.timeout-time.Minute/2 {
+			t.Errorf("%v: expected a deadline of %v, got %v", test.operation, test.timeout, remaining)
+		}
+		if tenant := ctx.Value(tenantKey{}); tenant != test.tenant {
+			t.Errorf("%v: expected tenant %v in the context, got %v", test.operation, test.tenant, tenant)
+		}
+		// The operation context is released once the response is written
+		if ctx.Err() != context.Canceled {
+			t.Errorf("%v: expected the context to be cancelled after the request, got %v", test.operation, ctx.Err())
+		}
+	}
+}
+
+// Blocks fetching instances until the context is done.
+type blockingService struct {
+	*fakeService
+	entered chan struct{}
+	err     chan error
+}
+
+func (s blockingService) FetchInstance(ctx context.Context, preq ProvisioningRequest) (InstanceResponse, error) {
+	close(s.entered)
+	<-ctx.Done()
+	s.err <- ctx.Err()
+	return InstanceResponse{}, ctx.Err()
+}
+
+func TestClientDisconnectCancelsOptionalInterfaces(t *testing.T) {
+	bs := blockingService{newFakeService("s1", "p1"), make(chan struct{}), make(chan error, 1)}
+	b, err := New(Options{Username: "admin", Password: "secret", OperationTimeout: time.Hour}, bs)
+	if err != nil {
+		t.Fatalf("Unable to create broker: %v", err)
+	}
+	h := b.Handler()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/v2/service_instances/i1", nil).WithContext(ctx)
+	req.Header.Set("X-Broker-Api-Version", MaxApiVersion.String())
+	req.SetBasicAuth("admin", "secret")
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	<-bs.entered
+	cancel()
+	if err := <-bs.err; err != context.Canceled {
+		t.Errorf("Expected the fetch to be cancelled with the request, got %v", err)
+	}
+	<-done
+}
+
+// Records the order the middleware is run in.
+type middlewareRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (m *middlewareRecorder) record(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, name)
+}
+
+func (m *middlewareRecorder) middleware(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			m.record(name)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+func (m *middlewareRecorder) recorded() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	calls := m.calls
+	m.calls = nil
+	return calls
+}
+
+func TestMountedBrokerRunsMiddlewareAfterAuthentication(t *testing.T) {
+	b, err := New(Options{Username: "admin", Password: "secret", OperationTimeout: time.Hour}, newFakeService("s1", "p1"))
+	if err != nil {
+		t.Fatalf("Unable to create broker: %v", err)
+	}
+	var m middlewareRecorder
+	b.Use(m.middleware("first"), m.middleware("second"))
+	b.Use(m.middleware("third"))
+
+	mux := http.NewServeMux()
+	b.Mount(mux, "/broker/")
+
+	tests := []struct {
+		name     string
+		url      string
+		version  string
+		password string
+		status   int
+		calls    []string
+	}{
+		{"authenticated", "/broker/v2/catalog", MaxApiVersion.String(), "secret", http.StatusOK, []string{"first", "second", "third"}},
+		{"unauthenticated", "/broker/v2/catalog", MaxApiVersion.String(), "wrong", http.StatusUnauthorized, nil},
+		{"unsupported version", "/broker/v2/catalog", "1.0", "secret", http.StatusPreconditionFailed, nil},
+		{"unknown route", "/broker/v2/unknown", MaxApiVersion.String(), "secret", http.StatusNotFound, []string{"first", "second", "third"}},
+		{"outside prefix", "/v2/catalog", MaxApiVersion.String(), "secret", http.StatusNotFound, nil},
+		{"probe", "/broker/healthz", "", "", http.StatusOK, nil},
+		{"metrics", "/broker/metrics", "", "secret", http.StatusOK, nil},
+		{"unauthenticated metrics", "/broker/metrics", "", "wrong", http.StatusUnauthorized, nil},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.version != "" {
+			req.Header.Set("X-Broker-Api-Version", test.version)
+		}
+		if test.password != "" {
+			req.SetBasicAuth("admin", test.password)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%v: expected %v, got %v", test.name, test.status, rec.Code)
+		}
+		if calls := m.recorded(); !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%v: expected middleware %v, got %v", test.name, test.calls, calls)
+		}
+	}
+}
+
+func TestReplacedAuthenticationRunsBeforeMiddleware(t *testing.T) {
+	b, err := New(Options{Username: "admin", Password: "secret", OperationTimeout: time.Hour}, newFakeService("s1", "p1"))
+	if err != nil {
+		t.Fatalf("Unable to create broker: %v", err)
+	}
+	var m middlewareRecorder
+	b.Use(m.middleware("custom"))
+	b.ReplaceAuthentication(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			m.record("authentication")
+			if req.Header.Get("X-Token") != "valid" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	})
+	h := b.Handler()
+
+	for _, test := range []struct {
+		token  string
+		status int
+		calls  []string
+	}{
+		{"valid", http.StatusOK, []string{"authentication", "custom"}},
+		{"invalid", http.StatusForbidden, []string{"authentication"}},
+	} {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		req.Header.Set("X-Broker-Api-Version", MaxApiVersion.String())
+		req.Header.Set("X-Token", test.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%v token: expected %v, got %v", test.token, test.status, rec.Code)
+		}
+		if calls := m.recorded(); !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%v token: expected %v, got %v", test.token, test.calls, calls)
+		}
+	}
+}
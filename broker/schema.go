@@ -0,0 +1,74 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Selects the input parameters schema of a plan applicable to an operation.
+type schemaSelector func(*Schemas) *InputParameters
+
+func instanceCreateSchema(s *Schemas) *InputParameters {
+	if s.ServiceInstance == nil {
+		return nil
+	}
+	return s.ServiceInstance.Create
+}
+
+func instanceUpdateSchema(s *Schemas) *InputParameters {
+	if s.ServiceInstance == nil {
+		return nil
+	}
+	return s.ServiceInstance.Update
+}
+
+func bindingCreateSchema(s *Schemas) *InputParameters {
+	if s.ServiceBinding == nil {
+		return nil
+	}
+	return s.ServiceBinding.Create
+}
+
+// Validates the parameters against the JSON Schema declared by the plan,
+// if any. Returns the list of violations found.
+func validateParameters(plan *Plan, selector schemaSelector, params map[string]interface{}) ([]FieldError, error) {
+	if plan == nil || plan.Schemas == nil {
+		return nil, nil
+	}
+	schema := selector(plan.Schemas)
+	if schema == nil || schema.Parameters == nil {
+		return nil, nil
+	}
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(schema.Parameters), gojsonschema.NewGoLoader(params))
+	if err != nil {
+		return nil, err
+	}
+
+	errs := []FieldError{}
+	for _, e := range result.Errors() {
+		errs = append(errs, FieldError{e.Field(), e.Description()})
+	}
+	return errs, nil
+}
+
+// Looks up a plan of a service in the catalog.
+func findPlan(cat Catalog, serviceId, planId string) *Plan {
+	for i := range cat.Services {
+		if cat.Services[i].Id != serviceId {
+			continue
+		}
+		for j := range cat.Services[i].Plans {
+			if cat.Services[i].Plans[j].Id == planId {
+				return &cat.Services[i].Plans[j]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Broker Service double offering a single service with a single plan.
+// Its operations complete asynchronously when accepted, and provisioning
+// blocks while the gate is set. Operations fail with the error, if set.
+type fakeService struct {
+	serviceId  string
+	planId     string
+	otherPlans []string
+	gate       chan struct{}
+	entered    chan struct{}
+	err        error
+
+	mu       sync.Mutex
+	state    OperationState
+	calls    []string
+	catalogs int
+}
+
+func newFakeService(serviceId, planId string) *fakeService {
+	return &fakeService{serviceId: serviceId, planId: planId, state: OperationInProgress}
+}
+
+func (s *fakeService) record(call string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+func (s *fakeService) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *fakeService) complete(state OperationState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+func (s *fakeService) catalogsServed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.catalogs
+}
+
+func (s *fakeService) Catalog(ctx context.Context) (Catalog, error) {
+	s.mu.Lock()
+	s.catalogs++
+	s.mu.Unlock()
+	plans := []Plan{{Id: s.planId, Name: s.planId}}
+	for _, id := range s.otherPlans {
+		plans = append(plans, Plan{Id: id, Name: id})
+	}
+	return Catalog{Services: []Service{{
+		Id:       s.serviceId,
+		Name:     s.serviceId,
+		Bindable: true,
+		Plans:    plans,
+	}}}, nil
+}
+
+func (s *fakeService) Provision(ctx context.Context, preq ProvisioningRequest) (ProvisioningResponse, error) {
+	s.record("provision " + preq.InstanceId)
+	if s.gate != nil {
+		s.entered <- struct{}{}
+		<-s.gate
+	}
+	if s.err != nil {
+		return ProvisioningResponse{}, s.err
+	}
+	return ProvisioningResponse{Async: preq.AcceptsIncomplete, Operation: "provision"}, nil
+}
+
+func (s *fakeService) Update(ctx context.Context, ureq UpdateRequest) (OperationResponse, error) {
+	s.record("update " + ureq.InstanceId)
+	return OperationResponse{Async: ureq.AcceptsIncomplete, Operation: "update"}, nil
+}
+
+func (s *fakeService) Deprovision(ctx context.Context, preq ProvisioningRequest) error {
+	s.record("deprovision " + preq.InstanceId)
+	return s.err
+}
+
+func (s *fakeService) Bind(ctx context.Context, breq BindingRequest) (BindingResponse, error) {
+	s.record("bind " + breq.BindingId)
+	if s.err != nil {
+		return BindingResponse{}, s.err
+	}
+	return BindingResponse{Async: breq.AcceptsIncomplete, Operation: "bind"}, nil
+}
+
+func (s *fakeService) Unbind(ctx context.Context, breq BindingRequest) (OperationResponse, error) {
+	s.record("unbind " + breq.BindingId)
+	if s.err != nil {
+		return OperationResponse{}, s.err
+	}
+	return OperationResponse{Async: breq.AcceptsIncomplete, Operation: "unbind"}, nil
+}
+
+func (s *fakeService) LastOperation(ctx context.Context, lreq LastOperationRequest) (LastOperation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return LastOperation{State: s.state}, nil
+}
+
+func (s *fakeService) LastBindingOperation(ctx context.Context, lreq LastOperationRequest) (LastOperation, error) {
+	return s.LastOperation(ctx, lreq)
+}
+
+func (s *fakeService) Reload(ctx context.Context) error {
+	s.record("Reload")
+	return s.err
+}
+
+func newTestBroker(t *testing.T, bs ContextBrokerService) http.Handler {
+	b, err := New(Options{Username: "admin", Password: "secret"}, bs)
+	if err != nil {
+		t.Fatalf("Unable to create broker: %v", err)
+	}
+	return b.Handler()
+}
+
+// Sends an authenticated Service Broker API request and returns the response
+// status together with the decoded error, if any.
+func serve(h http.Handler, method, url, body string) (int, BrokerError) {
+	var be BrokerError
+	return serveJson(h, method, url, body, &be), be
+}
+
+// Sends an authenticated Service Broker API request and decodes
+// the response into v.
+func serveJson(h http.Handler, method, url, body string, v interface{}) int {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, url, r)
+	req.Header.Set("X-Broker-Api-Version", MaxApiVersion.String())
+	req.SetBasicAuth("admin", "secret")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	json.Unmarshal(rec.Body.Bytes(), v)
+	return rec.Code
+}
@@ -0,0 +1,251 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type instanceState struct {
+	ServiceId    string                 `json:"service_id"`
+	PlanId       string                 `json:"plan_id"`
+	OrgId        string                 `json:"organization_guid,omitempty"`
+	SpaceId      string                 `json:"space_guid,omitempty"`
+	Context      PlatformContext        `json:"context"`
+	DashboardUrl string                 `json:"-"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	Operation    string                 `json:"operation,omitempty"`
+	Pending      bool                   `json:"pending,omitempty"`
+	Update       *instanceUpdate        `json:"update,omitempty"` // Pending asynchronous update
+}
+
+// Changes requested by an update, recorded once the update succeeds.
+type instanceUpdate struct {
+	PlanId     string                 `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+func (is *instanceState) apply(u instanceUpdate) {
+	is.PlanId = u.PlanId
+	if u.Parameters != nil {
+		is.Parameters = u.Parameters
+	}
+}
+
+// Reports whether a repeated provisioning request asks for the very same
+// service instance as the one recorded.
+func (is instanceState) matches(preq ProvisioningRequest) bool {
+	return is.ServiceId == preq.ServiceId &&
+		is.PlanId == preq.PlanId &&
+		is.OrgId == preq.OrgId &&
+		is.SpaceId == preq.SpaceId &&
+		is.Context == preq.Context &&
+		sameParameters(is.Parameters, preq.Parameters)
+}
+
+type bindingState struct {
+	ServiceId      string                 `json:"service_id"`
+	PlanId         string                 `json:"plan_id"`
+	AppId          string                 `json:"app_guid,omitempty"`
+	BindResource   *BindResource          `json:"bind_resource,omitempty"`
+	Context        PlatformContext        `json:"context"`
+	Credentials    Credentials            `json:"-"`
+	HasCredentials bool                   `json:"has_credentials,omitempty"`
+	SyslogDrainUrl string                 `json:"syslog_drain_url,omitempty"`
+	Parameters     map[string]interface{} `json:"parameters,omitempty"`
+	Operation      string                 `json:"operation,omitempty"`
+	Pending        bool                   `json:"pending,omitempty"`
+	Unbinding      bool                   `json:"unbinding,omitempty"`
+}
+
+// Reports whether a repeated binding request asks for the very same
+// binding as the one recorded.
+func (bs bindingState) matches(breq BindingRequest) bool {
+	return bs.ServiceId == breq.ServiceId &&
+		bs.PlanId == breq.PlanId &&
+		bs.AppId == breq.AppId &&
+		sameBindResource(bs.BindResource, breq.BindResource) &&
+		bs.Context == breq.Context &&
+		sameParameters(bs.Parameters, breq.Parameters)
+}
+
+// Reports whether the binding was created with credentials which are
+// no longer known, since they are not persisted.
+func (bs bindingState) credentialsLost() bool {
+	return bs.HasCredentials && bs.Credentials == nil
+}
+
+// Missing and empty bind resources are considered the same.
+func sameBindResource(a, b *BindResource) bool {
+	var ra, rb BindResource
+	if a != nil {
+		ra = *a
+	}
+	if b != nil {
+		rb = *b
+	}
+	return ra == rb
+}
+
+// Missing and empty parameters are considered the same.
+func sameParameters(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Records the attributes of provisioned service instances and created
+// bindings, so they can be retrieved by the Cloud Controller later on.
+// When backed by a file, the state is persisted on every change. Credentials
+// and dashboard URLs are secrets, so they are kept in memory only.
+type stateStore struct {
+	file string
+
+	mu        sync.RWMutex
+	Instances map[string]instanceState `json:"instances"`
+	Bindings  map[string]bindingState  `json:"bindings"`
+}
+
+func newStateStore(file string) (*stateStore, error) {
+	s := &stateStore{
+		file:      file,
+		Instances: make(map[string]instanceState),
+		Bindings:  make(map[string]bindingState),
+	}
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to load broker state from [%v]: %v", file, err))
+	}
+	slog.Info("Broker state loaded", "component", "store", "file", file, "instances", len(s.Instances), "bindings", len(s.Bindings))
+	return s, nil
+}
+
+func (s *stateStore) instance(iid string) (instanceState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	is, found := s.Instances[iid]
+	return is, found
+}
+
+// Returns a copy of the recorded service instances.
+func (s *stateStore) instances() map[string]instanceState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	instances := make(map[string]instanceState, len(s.Instances))
+	for iid, is := range s.Instances {
+		instances[iid] = is
+	}
+	return instances
+}
+
+// Reports whether any recorded service instance is of the plan.
+func (s *stateStore) planInUse(serviceId, planId string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, is := range s.Instances {
+		if is.ServiceId == serviceId && is.PlanId == planId {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stateStore) putInstance(iid string, is instanceState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Instances[iid] = is
+	s.save()
+}
+
+func (s *stateStore) removeInstance(iid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Instances, iid)
+	prefix := bindingKey(iid, "")
+	for key := range s.Bindings {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.Bindings, key)
+		}
+	}
+	s.save()
+}
+
+func (s *stateStore) binding(iid, bid string) (bindingState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bs, found := s.Bindings[bindingKey(iid, bid)]
+	return bs, found
+}
+
+// Returns a binding of the instance with an operation in progress, if any.
+func (s *stateStore) pendingBinding(iid string) (string, bindingState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix := bindingKey(iid, "")
+	for key, bs := range s.Bindings {
+		if bs.Pending && strings.HasPrefix(key, prefix) {
+			return strings.TrimPrefix(key, prefix), bs, true
+		}
+	}
+	return "", bindingState{}, false
+}
+
+func (s *stateStore) putBinding(iid, bid string, bs bindingState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Bindings[bindingKey(iid, bid)] = bs
+	s.save()
+}
+
+func (s *stateStore) removeBinding(iid, bid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Bindings, bindingKey(iid, bid))
+	s.save()
+}
+
+// Writes the state to a temporary file first and then renames it, so that
+// a crash never leaves a truncated state behind. Must be called with the
+// lock held.
+func (s *stateStore) save() {
+	if s.file == "" {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		slog.Error("Unable to marshal broker state", "component", "store", "error", err)
+		return
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		slog.Error("Unable to save broker state", "component", "store", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		slog.Error("Unable to save broker state", "component", "store", "error", err)
+	}
+}
+
+func bindingKey(iid, bid string) string {
+	return fmt.Sprintf("%v/%v", iid, bid)
+}
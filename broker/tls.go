@@ -0,0 +1,105 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Interval to check the certificate files for changes at, during handshakes.
+const tlsCheckInterval = 10 * time.Second
+
+// Protocols negotiated by the TLS listener, so that HTTP/2 keeps working
+// with the reloaded configurations.
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// Serves the TLS configuration built from the certificate, key and optional
+// client CA bundle files. The files are re-read once any of them changes,
+// or when reloaded explicitly (on SIGHUP), so rotated certificates are picked
+// up without restarting the broker.
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	watcher  *FileWatcher
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newTLSReloader(o Options) (*tlsReloader, error) {
+	if o.TLSCertFile == "" || o.TLSKeyFile == "" {
+		return nil, errors.New("Both TLS certificate and key files are required")
+	}
+	r := &tlsReloader{certFile: o.TLSCertFile, keyFile: o.TLSKeyFile, caFile: o.TLSClientCAFile}
+	watcher, err := NewFileWatcher(tlsCheckInterval, r.load, r.files()...)
+	if err != nil {
+		return nil, err
+	}
+	r.watcher = watcher
+	return r, nil
+}
+
+// Returns the configuration for the TLS listener.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: tlsNextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if err := r.watcher.Check(); err != nil {
+				slog.Warn("Keeping previous certificates", "component", "tls", "error", err)
+			}
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	}
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   tlsNextProtos,
+	}
+
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New(fmt.Sprintf("No certificates found in: [%v]", r.caFile))
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	r.config = config
+	r.mu.Unlock()
+
+	slog.Info("Certificates loaded", "component", "tls", "files", r.files())
+	return nil
+}
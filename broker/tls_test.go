@@ -0,0 +1,128 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for the common name and its key,
+// moving their modification times forward.
+func writeCertificate(t *testing.T, certFile, keyFile, name string, modified time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modified)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), modified)
+}
+
+func writeFile(t *testing.T, file string, data []byte, modified time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Unable to write %v: %v", file, err)
+	}
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatalf("Unable to touch %v: %v", file, err)
+	}
+}
+
+// Returns the common name of the certificate served to a new client.
+func servedName(t *testing.T, r *tlsReloader) string {
+	t.Helper()
+	config, err := r.serverConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("Unable to get TLS configuration: %v", err)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("Unable to parse certificate: %v", err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertificateIsReloaded(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modified := time.Now()
+	writeCertificate(t, certFile, keyFile, "first", modified)
+
+	r, err := newTLSReloader(Options{TLSCertFile: certFile, TLSKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %v", err)
+	}
+	if name := servedName(t, r); name != "first" {
+		t.Fatalf("Expected the first certificate, got %v", name)
+	}
+
+	r.watcher.interval = 0
+	modified = modified.Add(time.Minute)
+	writeCertificate(t, certFile, keyFile, "second", modified)
+	if name := servedName(t, r); name != "second" {
+		t.Errorf("Expected the rotated certificate, got %v", name)
+	}
+
+	// An invalid certificate keeps the previous one in place
+	modified = modified.Add(time.Minute)
+	writeFile(t, certFile, []byte("not a certificate"), modified)
+	if name := servedName(t, r); name != "second" {
+		t.Errorf("Expected the previous certificate to be kept, got %v", name)
+	}
+	if err := r.watcher.Reload(); err == nil {
+		t.Errorf("Expected the invalid certificate to be rejected when reloaded")
+	}
+	if name := servedName(t, r); name != "second" {
+		t.Errorf("Expected the previous certificate to be kept after reloading, got %v", name)
+	}
+}
+
+func TestInvalidCertificateIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "broker", time.Now())
+
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"missing key", Options{TLSCertFile: certFile}},
+		{"missing file", Options{TLSCertFile: filepath.Join(dir, "missing.pem"), TLSKeyFile: keyFile}},
+		{"swapped files", Options{TLSCertFile: keyFile, TLSKeyFile: certFile}},
+		{"invalid client CA", Options{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: keyFile}},
+	}
+	for _, test := range tests {
+		if _, err := newTLSReloader(test.options); err == nil {
+			t.Errorf("%v: expected the configuration to be rejected", test.name)
+		}
+	}
+}
@@ -4,6 +4,10 @@
 
 package broker
 
+import (
+	"context"
+)
+
 // The BrokerService defines the internal API used by the broker's HTTP endpoints.
 type BrokerService interface {
 
@@ -12,19 +16,102 @@ type BrokerService interface {
 	Catalog() (Catalog, error)
 
 	// Creates a service instance of a specified service and plan.
-	// Returns the optional management URL.
-	Provision(ProvisioningRequest) (string, error)
+	// Returns the optional management URL and whether the provisioning
+	// is still in progress. Services may only complete asynchronously
+	// when the request accepts incomplete operations.
+	Provision(ProvisioningRequest) (ProvisioningResponse, error)
+
+	// Changes the plan or parameters of a service instance.
+	// Returns whether the update is still in progress.
+	Update(UpdateRequest) (OperationResponse, error)
 
 	// Removes created service instance.
 	Deprovision(ProvisioningRequest) error
 
 	// Binds to specified service instance.
 	// Returns  credentials necessary to establish connection to this
-	// service instance as well as optional syslog drain URL.
-	Bind(BindingRequest) (Credentials, string, error)
+	// service instance as well as optional syslog drain URL, unless
+	// the binding is still in progress.
+	Bind(BindingRequest) (BindingResponse, error)
 
 	// Removes created binding.
-	Unbind(BindingRequest) error
+	// Returns whether the unbinding is still in progress.
+	Unbind(BindingRequest) (OperationResponse, error)
+}
+
+// The ContextBrokerService is the context-aware variant of the BrokerService.
+// The context of each operation expires once its configured deadline passes
+// or the client gives up on the request, see Adapt for the BrokerService.
+type ContextBrokerService interface {
+	Catalog(context.Context) (Catalog, error)
+	Provision(context.Context, ProvisioningRequest) (ProvisioningResponse, error)
+	Update(context.Context, UpdateRequest) (OperationResponse, error)
+	Deprovision(context.Context, ProvisioningRequest) error
+	Bind(context.Context, BindingRequest) (BindingResponse, error)
+	Unbind(context.Context, BindingRequest) (OperationResponse, error)
+}
+
+// The AsyncBrokerService is implemented by Broker Services able to
+// complete operations asynchronously.
+type AsyncBrokerService interface {
+
+	// Reports the state of the last operation performed on a service instance.
+	LastOperation(context.Context, LastOperationRequest) (LastOperation, error)
+
+	// Reports the state of the last operation performed on a binding.
+	LastBindingOperation(context.Context, LastOperationRequest) (LastOperation, error)
+}
+
+// The InstanceRetriever is implemented by Broker Services able to retrieve
+// their service instances. Otherwise the attributes recorded by the broker
+// are returned.
+type InstanceRetriever interface {
+
+	// Retrieves a provisioned service instance.
+	FetchInstance(context.Context, ProvisioningRequest) (InstanceResponse, error)
+}
+
+// The BindingRetriever is implemented by Broker Services able to retrieve
+// their bindings. Broker Services binding asynchronously should implement
+// it, since the credentials are not known to the broker otherwise.
+type BindingRetriever interface {
+
+	// Retrieves the credentials of a binding once it has been created.
+	FetchBinding(context.Context, BindingRequest) (BindingResponse, error)
+}
+
+// The HealthChecker is implemented by Broker Services able to verify their
+// backing service is reachable. The broker is considered ready otherwise.
+type HealthChecker interface {
+
+	// Returns an error if the backing service cannot be used.
+	CheckHealth(context.Context) error
+}
+
+// The CapabilityRouter is implemented by Broker Services composed of others,
+// whose optional interfaces differ from service to service.
+type CapabilityRouter interface {
+
+	// Returns the Broker Service offering the service to look up the optional
+	// interfaces on, or nil if the service is unknown.
+	CapabilitiesFor(serviceId string) interface{}
+}
+
+// The Drainer is implemented by Broker Services completing operations
+// in background, so the broker can wait for them on shutdown.
+type Drainer interface {
+
+	// Waits for the operations in progress to complete or the context to be
+	// done. Returns the descriptions of the operations still in progress.
+	Drain(context.Context) []string
+}
+
+// The Reloader is implemented by Broker Services reading their configuration
+// from files, so the broker can have them re-read on SIGHUP.
+type Reloader interface {
+
+	// Re-reads the configuration, keeping the previous one if invalid.
+	Reload(context.Context) error
 }
 
 const (
@@ -32,10 +119,42 @@ const (
 	ErrCodeConflict = 10
 	// Raised by Broker Service if service instance or service instance binding cannot be found
 	ErrCodeGone = 20
+	// Raised by Broker Service if service instance or service instance binding does not exist (yet)
+	ErrCodeNotFound = 30
+	// Raised by Broker Service if the request is malformed or refers to unknown entities
+	ErrCodeBadRequest = 40
+	// Raised by Broker Service if the request is well-formed but cannot be fulfilled
+	ErrCodeUnprocessableEntity = 50
+	// Raised by Broker Service if the operation can only be completed asynchronously
+	ErrCodeAsyncRequired = 51
+	// Raised by Broker Service if the binding requires an application
+	ErrCodeRequiresApp = 52
+	// Raised by Broker Service if the maintenance info does not match the one in the catalog
+	ErrCodeMaintenanceInfoConflict = 53
+	// Raised by Broker Service if another operation is in progress for the same resource
+	ErrCodeConcurrency = 54
+	// Raised by Broker Service if the backing service is temporarily unavailable
+	ErrCodeServiceUnavailable = 60
 	// Raised by Broker Service for any other issues
 	ErrCodeOther = 99
 )
 
+// Error codes returned in the error responses. Errors without a code defined
+// by the specification are named after their HTTP status, unless the status
+// has codes of its own, like 422 Unprocessable Entity, see
+// https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#service-broker-errors
+const (
+	ErrorConflict                = "Conflict"
+	ErrorGone                    = "Gone"
+	ErrorNotFound                = "NotFound"
+	ErrorBadRequest              = "BadRequest"
+	ErrorAsyncRequired           = "AsyncRequired"
+	ErrorRequiresApp             = "RequiresApp"
+	ErrorMaintenanceInfoConflict = "MaintenanceInfoConflict"
+	ErrorConcurrency             = "ConcurrencyError"
+	ErrorServiceUnavailable      = "ServiceUnavailable"
+)
+
 type BrokerServiceError interface {
 	Code() int
 	Error() string
@@ -43,20 +162,129 @@ type BrokerServiceError interface {
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#provisioning
 type ProvisioningRequest struct {
+	RequestLogger
+	InstanceId        string                 `json:"-"`
+	ApiVersion        ApiVersion             `json:"-"`
+	AcceptsIncomplete bool                   `json:"-"`
+	Identity          OriginatingIdentity    `json:"-"`
+	Context           PlatformContext        `json:"context"`
+	ServiceId         string                 `json:"service_id"`
+	PlanId            string                 `json:"plan_id"`
+	OrgId             string                 `json:"organization_guid"`
+	SpaceId           string                 `json:"space_guid"`
+	Parameters        map[string]interface{} `json:"parameters,omitempty"`
+	MaintenanceInfo   *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#maintenance-info-object
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Contextual data about the platform and the location of the service
+// instance or binding within it.
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/profile.md#context-object
+type PlatformContext struct {
+	Platform     string `json:"platform,omitempty"`
+	OrgId        string `json:"organization_guid,omitempty"`
+	SpaceId      string `json:"space_guid,omitempty"`
+	InstanceName string `json:"instance_name,omitempty"`
+}
+
+type InstanceResponse struct {
+	ServiceId    string                 `json:"service_id"`
+	PlanId       string                 `json:"plan_id"`
+	DashboardUrl string                 `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type ProvisioningResponse struct {
+	DashboardUrl string `json:"dashboard_url,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+	Async        bool   `json:"-"`
+}
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#updating-a-service-instance
+type UpdateRequest struct {
+	RequestLogger
+	InstanceId        string                 `json:"-"`
+	ApiVersion        ApiVersion             `json:"-"`
+	AcceptsIncomplete bool                   `json:"-"`
+	Identity          OriginatingIdentity    `json:"-"`
+	Context           PlatformContext        `json:"context"`
+	ServiceId         string                 `json:"service_id"`
+	PlanId            string                 `json:"plan_id,omitempty"`
+	Parameters        map[string]interface{} `json:"parameters,omitempty"`
+	PreviousValues    PreviousValues         `json:"previous_values"`
+	MaintenanceInfo   *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+// Information about the service instance prior to the update.
+type PreviousValues struct {
+	ServiceId       string           `json:"service_id,omitempty"`
+	PlanId          string           `json:"plan_id,omitempty"`
+	OrgId           string           `json:"organization_id,omitempty"`
+	SpaceId         string           `json:"space_id,omitempty"`
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#polling-last-operation-for-service-instances
+type LastOperationRequest struct {
+	RequestLogger
 	InstanceId string `json:"-"`
-	ServiceId  string `json:"service_id"`
-	PlanId     string `json:"plan_id"`
-	OrgId      string `json:"organization_guid"`
-	SpaceId    string `json:"space_guid"`
+	BindingId  string `json:"-"`
+	ServiceId  string `json:"-"`
+	PlanId     string `json:"-"`
+	Operation  string `json:"-"`
+}
+
+type OperationState string
+
+const (
+	OperationInProgress OperationState = "in progress"
+	OperationSucceeded  OperationState = "succeeded"
+	OperationFailed     OperationState = "failed"
+)
+
+type LastOperation struct {
+	State       OperationState `json:"state"`
+	Description string         `json:"description,omitempty"`
 }
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#binding
 type BindingRequest struct {
-	InstanceId string `json:"-"`
-	BindingId  string `json:"-"`
-	ServiceId  string `json:"service_id"`
-	PlanId     string `json:"plan_id"`
-	AppId      string `json:"app_guid"`
+	RequestLogger
+	InstanceId        string                 `json:"-"`
+	BindingId         string                 `json:"-"`
+	ApiVersion        ApiVersion             `json:"-"`
+	AcceptsIncomplete bool                   `json:"-"`
+	Identity          OriginatingIdentity    `json:"-"`
+	Context           PlatformContext        `json:"context"`
+	ServiceId         string                 `json:"service_id"`
+	PlanId            string                 `json:"plan_id"`
+	AppId             string                 `json:"app_guid"`
+	BindResource      *BindResource          `json:"bind_resource,omitempty"`
+	Parameters        map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// The resource the binding is created for.
+type BindResource struct {
+	AppId string `json:"app_guid,omitempty"`
+	Route string `json:"route,omitempty"`
+}
+
+type BindingResponse struct {
+	Credentials    Credentials            `json:"credentials,omitempty"`
+	SyslogDrainUrl string                 `json:"syslog_drain_url,omitempty"`
+	Parameters     map[string]interface{} `json:"parameters,omitempty"`
+	Operation      string                 `json:"operation,omitempty"`
+	Async          bool                   `json:"-"`
+}
+
+type OperationResponse struct {
+	Operation string `json:"operation,omitempty"`
+	Async     bool   `json:"-"`
 }
 
 type Credentials map[string]interface{}
@@ -68,25 +296,72 @@ type Catalog struct {
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
 type Service struct {
-	Id          string                 `json:"id"`
-	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
-	Bindable    bool                   `json:"bindable"`
-	Tags        []string               `json:"tags,omitempty"`
-	Requires    []string               `json:"requires,omitempty"`
-	Plans       []Plan                 `json:"plans"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Id                   string                 `json:"id"`
+	Name                 string                 `json:"name"`
+	Description          string                 `json:"description"`
+	Bindable             bool                   `json:"bindable"`
+	PlanUpdateable       bool                   `json:"plan_updateable,omitempty"`
+	InstancesRetrievable bool                   `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool                   `json:"bindings_retrievable,omitempty"`
+	Tags                 []string               `json:"tags,omitempty"`
+	AllowContextUpdates  bool                   `json:"allow_context_updates,omitempty"`
+	Requires             []string               `json:"requires,omitempty"`
+	Plans                []Plan                 `json:"plans"`
+	Metadata             map[string]interface{} `json:"metadata,omitempty"`
+	DashboardClient      *DashboardClient       `json:"dashboard_client,omitempty"`
+}
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#dashboard-client-object
+type DashboardClient struct {
+	Id          string `json:"id"`
+	Secret      string `json:"secret"`
+	RedirectUri string `json:"redirect_uri,omitempty"`
 }
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
+// Optional flags are pointers, since their defaults differ from zero values
+// or are inherited from the service.
 type Plan struct {
-	Id          string                 `json:"id"`
-	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Id                     string                 `json:"id"`
+	Name                   string                 `json:"name"`
+	Description            string                 `json:"description"`
+	Metadata               map[string]interface{} `json:"metadata,omitempty"`
+	Free                   *bool                  `json:"free,omitempty"`
+	Bindable               *bool                  `json:"bindable,omitempty"`
+	PlanUpdateable         *bool                  `json:"plan_updateable,omitempty"`
+	Schemas                *Schemas               `json:"schemas,omitempty"`
+	MaintenanceInfo        *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+	MaximumPollingDuration int                    `json:"maximum_polling_duration,omitempty"`
+}
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#schemas-object
+type Schemas struct {
+	ServiceInstance *ServiceInstanceSchema `json:"service_instance,omitempty"`
+	ServiceBinding  *ServiceBindingSchema  `json:"service_binding,omitempty"`
+}
+
+type ServiceInstanceSchema struct {
+	Create *InputParameters `json:"create,omitempty"`
+	Update *InputParameters `json:"update,omitempty"`
+}
+
+type ServiceBindingSchema struct {
+	Create *InputParameters `json:"create,omitempty"`
+}
+
+// Holds the JSON Schema the configuration parameters are validated against.
+type InputParameters struct {
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
 }
 
 // Other types
 type BrokerError struct {
+	Error       string       `json:"error,omitempty"`
+	Description string       `json:"description"`
+	Fields      []FieldError `json:"fields,omitempty"`
+}
+
+type FieldError struct {
+	Field       string `json:"field"`
 	Description string `json:"description"`
 }
@@ -0,0 +1,56 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Version of the Service Broker API as sent by the Cloud Controller
+// in the 'X-Broker-Api-Version' header.
+type ApiVersion struct {
+	Major int
+	Minor int
+}
+
+// The earliest Service Broker API version this broker is able to serve, and
+// the latest one whose features it implements. Any later minor version of
+// the same major version is served too, since the API keeps minor versions
+// backward compatible.
+var (
+	MinApiVersion = ApiVersion{2, 0}
+	MaxApiVersion = ApiVersion{2, 17}
+)
+
+func (v ApiVersion) String() string {
+	return fmt.Sprintf("%v.%v", v.Major, v.Minor)
+}
+
+// Reports whether v is the same as, or a later version than, o.
+func (v ApiVersion) AtLeast(o ApiVersion) bool {
+	return v.Major > o.Major || (v.Major == o.Major && v.Minor >= o.Minor)
+}
+
+// Reports whether v is at least MinApiVersion, with a major version no later
+// than the one of MaxApiVersion.
+func (v ApiVersion) isSupported() bool {
+	return v.Major >= MinApiVersion.Major && v.Major <= MaxApiVersion.Major && v.AtLeast(MinApiVersion)
+}
+
+type apiVersionKey struct{}
+
+func withApiVersion(req *http.Request, v ApiVersion) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), apiVersionKey{}, v))
+}
+
+// Returns the API version negotiated for the given request.
+func apiVersionOf(req *http.Request) ApiVersion {
+	if v, ok := req.Context().Value(apiVersionKey{}).(ApiVersion); ok {
+		return v
+	}
+	return MinApiVersion
+}
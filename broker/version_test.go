@@ -0,0 +1,94 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExtractVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		expected ApiVersion
+		err      string
+	}{
+		{"missing", nil, ApiVersion{}, "Missing Broker API version"},
+		{"repeated", []string{"2.14", "2.15"}, ApiVersion{}, "Missing Broker API version"},
+		{"empty", []string{""}, ApiVersion{}, "Invalid Broker API version"},
+		{"major only", []string{"2"}, ApiVersion{}, "Invalid Broker API version"},
+		{"patch version", []string{"2.14.1"}, ApiVersion{}, "Invalid Broker API version"},
+		{"not a number", []string{"2.x"}, ApiVersion{}, "Invalid Broker API version"},
+		{"valid", []string{"2.14"}, ApiVersion{2, 14}, ""},
+		{"old", []string{"1.3"}, ApiVersion{1, 3}, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		for _, header := range test.headers {
+			req.Header.Add("X-Broker-Api-Version", header)
+		}
+		version, err := extractVersion(req)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("%v: expected error %q, got %v", test.name, test.err, err)
+		case version != test.expected:
+			t.Errorf("%v: expected version %v, got %v", test.name, test.expected, version)
+		}
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	tests := []struct {
+		version   ApiVersion
+		supported bool
+	}{
+		{ApiVersion{1, 13}, false},
+		{ApiVersion{2, -1}, false},
+		{MinApiVersion, true},
+		{ApiVersion{2, 14}, true},
+		{MaxApiVersion, true},
+		{ApiVersion{2, 99}, true},
+		{ApiVersion{3, 0}, false},
+	}
+	for _, test := range tests {
+		if supported := test.version.isSupported(); supported != test.supported {
+			t.Errorf("%v: expected supported: %v, got %v", test.version, test.supported, supported)
+		}
+	}
+}
+
+func TestUnsupportedVersionsAreRejected(t *testing.T) {
+	h := newTestBroker(t, newFakeService("s1", "p1"))
+
+	tests := []struct {
+		header   string
+		status   int
+		expected string
+	}{
+		{"", http.StatusPreconditionFailed, "Missing Broker API version"},
+		{"two", http.StatusPreconditionFailed, "Invalid Broker API version"},
+		{"1.3", http.StatusPreconditionFailed, "Unsupported Broker API version: [1.3], supported: [2.0] or any later [2.x]"},
+		{"3.0", http.StatusPreconditionFailed, "Unsupported Broker API version: [3.0]"},
+		{"2.99", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		if test.header != "" {
+			req.Header.Set("X-Broker-Api-Version", test.header)
+		}
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.status || !strings.Contains(rec.Body.String(), test.expected) {
+			t.Errorf("%q: expected %v with %q, got %v with %s", test.header, test.status, test.expected, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Re-reads a set of files once any of them changes, so that certificates,
+// credentials or catalogs can be replaced without restarting the broker.
+// The modification times are checked at most once per interval and the
+// reloads are serialized. Files which failed to load are not retried until
+// they change again, so the previous content stays in place meanwhile.
+type FileWatcher struct {
+	files    []string
+	interval time.Duration
+	load     func() error
+
+	reloadMu sync.Mutex // Serializes the reloads
+
+	mu        sync.Mutex
+	loaded    []time.Time // Modification times of the files last loaded
+	rejected  []time.Time // Modification times of the files last rejected
+	lastCheck time.Time
+}
+
+// Returns a watcher loading the files by the function, which is called
+// right away. Fails if the files cannot be loaded.
+func NewFileWatcher(interval time.Duration, load func() error, files ...string) (*FileWatcher, error) {
+	w := &FileWatcher{files: files, interval: interval, load: load}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Reloads the files if the check interval elapsed and any of them changed
+// since last loaded or rejected.
+func (w *FileWatcher) Check() error {
+	if !w.due() {
+		return nil
+	}
+
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	modTimes, err := modTimesOf(w.files)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	unchanged := sameTimes(modTimes, w.loaded) || sameTimes(modTimes, w.rejected)
+	w.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	return w.reload(modTimes)
+}
+
+// Reloads the files regardless of their modification times, e.g. on SIGHUP.
+func (w *FileWatcher) Reload() error {
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	modTimes, err := modTimesOf(w.files)
+	if err != nil {
+		return err
+	}
+	return w.reload(modTimes)
+}
+
+// Must be called with the reload lock held.
+func (w *FileWatcher) reload(modTimes []time.Time) error {
+	err := w.load()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.rejected = modTimes
+	} else {
+		w.loaded, w.rejected = modTimes, nil
+	}
+	w.lastCheck = time.Now()
+	return err
+}
+
+// Reports whether the check interval elapsed since the files were last
+// checked, restarting it if so.
+func (w *FileWatcher) due() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if time.Since(w.lastCheck) < w.interval {
+		return false
+	}
+	w.lastCheck = time.Now()
+	return true
+}
+
+func modTimesOf(files []string) ([]time.Time, error) {
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "watched")
+	modified := time.Now()
+	touch := func(content string) {
+		modified = modified.Add(time.Minute)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+		os.Chtimes(file, modified, modified)
+	}
+	touch("valid")
+
+	loads := 0
+	w, err := NewFileWatcher(time.Hour, func() error {
+		loads++
+		data, _ := ioutil.ReadFile(file)
+		if string(data) != "valid" {
+			return errors.New("Invalid content")
+		}
+		return nil
+	}, file)
+	if err != nil || loads != 1 {
+		t.Fatalf("Expected the file to be loaded right away, got %v loads: %v", loads, err)
+	}
+
+	// Changes are picked up only once the check interval elapsed
+	touch("valid")
+	if err := w.Check(); err != nil || loads != 1 {
+		t.Errorf("Expected the file not to be checked within the interval, got %v loads: %v", loads, err)
+	}
+	w.interval = 0
+	if err := w.Check(); err != nil || loads != 2 {
+		t.Errorf("Expected the changed file to be loaded, got %v loads: %v", loads, err)
+	}
+	if err := w.Check(); err != nil || loads != 2 {
+		t.Errorf("Expected the unchanged file not to be loaded, got %v loads: %v", loads, err)
+	}
+
+	// Rejected files are not retried until they change again
+	touch("invalid")
+	if err := w.Check(); err == nil || loads != 3 {
+		t.Errorf("Expected the invalid file to be rejected, got %v loads: %v", loads, err)
+	}
+	if err := w.Check(); err != nil || loads != 3 {
+		t.Errorf("Expected the rejected file not to be retried, got %v loads: %v", loads, err)
+	}
+	if err := w.Reload(); err == nil || loads != 4 {
+		t.Errorf("Expected the rejected file to be retried when reloaded, got %v loads: %v", loads, err)
+	}
+	touch("valid")
+	if err := w.Check(); err != nil || loads != 5 {
+		t.Errorf("Expected the fixed file to be loaded, got %v loads: %v", loads, err)
+	}
+
+	os.Remove(file)
+	if err := w.Check(); err == nil || loads != 5 {
+		t.Errorf("Expected the missing file to be reported, got %v loads: %v", loads, err)
+	}
+}
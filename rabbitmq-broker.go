@@ -5,10 +5,10 @@
 package main
 
 import (
-	"bitbucket.org/michaljemala/cf-service-broker/broker"
-	"bitbucket.org/michaljemala/cf-service-broker/rabbitmq"
 	"flag"
 	"fmt"
+	"github.com/michaljemala/cf-service-broker/broker"
+	"github.com/michaljemala/cf-service-broker/rabbitmq"
 	"log"
 	"os"
 )
@@ -31,12 +31,19 @@ func main() {
 		Version()
 	}
 
+	if err := broker.ConfigureLogging(broker.Opts); err != nil {
+		log.Fatal(err)
+	}
+
 	brokerService, err := rabbitmq.New(rabbitmq.Opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	broker := broker.New(broker.Opts, brokerService)
+	broker, err := broker.New(broker.Opts, brokerService)
+	if err != nil {
+		log.Fatal(err)
+	}
 	broker.Start()
 }
 
@@ -5,11 +5,14 @@
 package rabbitmq
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/michaelklishin/rabbit-hole"
+	"github.com/michaelklishin/rabbit-hole/v2"
 	"github.com/michaljemala/cf-service-broker/broker"
+	"log/slog"
 	"net/http"
+	"time"
 )
 
 type rabbitAdminError struct {
@@ -21,11 +24,17 @@ func (e *rabbitAdminError) Code() int {
 	return e.code
 }
 func (e *rabbitAdminError) Error() string {
-	return fmt.Sprintf("%v: %v", e.code, e.err.Error())
+	return e.err.Error()
 }
 
 type rabbitAdmin struct {
-	client *rabbithole.Client
+	url       string
+	username  string
+	password  string
+	transport http.RoundTripper
+	client    *rabbithole.Client
+	ctx       context.Context
+	log       *slog.Logger
 }
 
 func newRabbitAdmin(brokerUrl, username, password string) (*rabbitAdmin, error) {
@@ -33,20 +42,68 @@ func newRabbitAdmin(brokerUrl, username, password string) (*rabbitAdmin, error)
 	if err != nil {
 		return nil, err
 	}
-	return &rabbitAdmin{client}, nil
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	client.SetTransport(transport)
+	return &rabbitAdmin{brokerUrl, username, password, transport, client, context.Background(), slog.Default()}, nil
 }
 
-func (a *rabbitAdmin) isVhost(username string) (bool, error) {
-	info, err := a.client.GetVhost(username)
-	if info != nil {
+// Returns an admin logging its management API calls in the context of
+// a request and aborting them once the context is done. The connections
+// to the management API are shared by all the admins.
+func (a *rabbitAdmin) withContext(ctx context.Context, l *slog.Logger) (*rabbitAdmin, error) {
+	client, err := rabbithole.NewClient(a.url, a.username, a.password)
+	if err != nil {
+		return nil, &rabbitAdminError{broker.ErrCodeOther, err}
+	}
+	client.SetTransport(&contextTransport{ctx, a.transport})
+	return &rabbitAdmin{a.url, a.username, a.password, a.transport, client, ctx, l.With("component", "admin")}, nil
+}
+
+// Transport sending the management API requests with the given context,
+// so they are aborted once it is done.
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
+
+// Logs the outcome of a management API call started at the given time
+// and records it in the metrics. Calls aborted due to the context being
+// done are reported as such.
+func (a *rabbitAdmin) logCall(call string, start time.Time, err *error, args ...interface{}) {
+	if *err != nil && a.ctx.Err() != nil {
+		*err = &rabbitAdminError{broker.ErrCodeServiceUnavailable, a.ctx.Err()}
+	}
+
+	duration := time.Since(start)
+	observeCall(call, duration, *err)
+
+	args = append(args, "call", call, "duration", duration)
+	if *err != nil {
+		a.log.Warn("Management API call failed", append(args, "error", *err)...)
+		return
+	}
+	a.log.Debug("Management API call", args...)
+}
+
+func (a *rabbitAdmin) isVhost(vhostname string) (found bool, err error) {
+	defer a.logCall("is_vhost", time.Now(), &err, "vhost", vhostname)
+
+	_, err = a.client.GetVhost(vhostname)
+	if err == nil {
 		return true, nil
-	} else if err.Error() == "not found" { // TODO: Create PR to expose the 404 in more user-friendly way
+	} else if isNotFound(err) {
 		return false, nil
 	}
 	return false, &rabbitAdminError{broker.ErrCodeOther, err}
 }
 
-func (a *rabbitAdmin) createVhost(vhostname string, tracing bool) error {
+func (a *rabbitAdmin) createVhost(vhostname string, settings rabbithole.VhostSettings) (err error) {
+	defer a.logCall("create_vhost", time.Now(), &err, "vhost", vhostname)
+
 	if found, err := a.isVhost(vhostname); err != nil {
 		return err
 	} else if found {
@@ -54,7 +111,23 @@ func (a *rabbitAdmin) createVhost(vhostname string, tracing bool) error {
 		return &rabbitAdminError{broker.ErrCodeConflict, errors.New(msg)}
 	}
 
-	settings := rabbithole.VhostSettings{tracing}
+	return a.putVhost(vhostname, settings)
+}
+
+func (a *rabbitAdmin) updateVhost(vhostname string, settings rabbithole.VhostSettings) (err error) {
+	defer a.logCall("update_vhost", time.Now(), &err, "vhost", vhostname)
+
+	if found, err := a.isVhost(vhostname); err != nil {
+		return err
+	} else if !found {
+		msg := fmt.Sprintf("Virtual host not found: [%v]", vhostname)
+		return &rabbitAdminError{broker.ErrCodeNotFound, errors.New(msg)}
+	}
+
+	return a.putVhost(vhostname, settings)
+}
+
+func (a *rabbitAdmin) putVhost(vhostname string, settings rabbithole.VhostSettings) error {
 	resp, err := a.client.PutVhost(vhostname, settings)
 	if err != nil {
 		return &rabbitAdminError{broker.ErrCodeOther, err}
@@ -62,25 +135,31 @@ func (a *rabbitAdmin) createVhost(vhostname string, tracing bool) error {
 	return checkResponseAndClose(resp)
 }
 
-func (a *rabbitAdmin) deleteVhost(vhostname string) error {
+func (a *rabbitAdmin) deleteVhost(vhostname string) (err error) {
+	defer a.logCall("delete_vhost", time.Now(), &err, "vhost", vhostname)
+
 	resp, err := a.client.DeleteVhost(vhostname)
 	if err != nil {
-		return &rabbitAdminError{broker.ErrCodeOther, err}
+		return adminError(err)
 	}
 	return checkResponseAndClose(resp)
 }
 
-func (a *rabbitAdmin) isUser(username string) (bool, error) {
-	info, err := a.client.GetUser(username)
-	if info != nil {
+func (a *rabbitAdmin) isUser(username string) (found bool, err error) {
+	defer a.logCall("is_user", time.Now(), &err, "user", username)
+
+	_, err = a.client.GetUser(username)
+	if err == nil {
 		return true, nil
-	} else if err.Error() == "not found" {
+	} else if isNotFound(err) {
 		return false, nil
 	}
 	return false, &rabbitAdminError{broker.ErrCodeOther, err}
 }
 
-func (a *rabbitAdmin) createUser(username, password string) error {
+func (a *rabbitAdmin) createUser(username, password string) (err error) {
+	defer a.logCall("create_user", time.Now(), &err, "user", username)
+
 	if found, err := a.isUser(username); err != nil {
 		return err
 	} else if found {
@@ -91,7 +170,7 @@ func (a *rabbitAdmin) createUser(username, password string) error {
 	settings := rabbithole.UserSettings{
 		Name:     username,
 		Password: password,
-		Tags:     "management",
+		Tags:     rabbithole.UserTags{"management"},
 	}
 	resp, err := a.client.PutUser(username, settings)
 	if err != nil {
@@ -100,16 +179,20 @@ func (a *rabbitAdmin) createUser(username, password string) error {
 	return checkResponseAndClose(resp)
 }
 
-func (a *rabbitAdmin) deleteUser(username string) error {
+func (a *rabbitAdmin) deleteUser(username string) (err error) {
+	defer a.logCall("delete_user", time.Now(), &err, "user", username)
+
 	resp, err := a.client.DeleteUser(username)
 	if err != nil {
-		return &rabbitAdminError{broker.ErrCodeOther, err}
+		return adminError(err)
 	}
 	return checkResponseAndClose(resp)
 }
 
-func (a *rabbitAdmin) grantAllPermissionsIn(username, vhostname string) error {
-	unlimited := rabbithole.Permissions{".*", ".*", ".*"}
+func (a *rabbitAdmin) grantAllPermissionsIn(username, vhostname string) (err error) {
+	defer a.logCall("grant_permissions", time.Now(), &err, "user", username, "vhost", vhostname)
+
+	unlimited := rabbithole.Permissions{Configure: ".*", Write: ".*", Read: ".*"}
 	resp, err := a.client.UpdatePermissionsIn(vhostname, username, unlimited)
 	if err != nil {
 		return &rabbitAdminError{broker.ErrCodeOther, err}
@@ -117,6 +200,51 @@ func (a *rabbitAdmin) grantAllPermissionsIn(username, vhostname string) error {
 	return checkResponseAndClose(resp)
 }
 
+func (a *rabbitAdmin) overview() (err error) {
+	defer a.logCall("overview", time.Now(), &err)
+
+	if _, err := a.client.Overview(); err != nil {
+		return &rabbitAdminError{broker.ErrCodeServiceUnavailable, err}
+	}
+	return nil
+}
+
+// Verifies the management user is tagged as administrator, as required
+// to manage virtual hosts, users and their permissions.
+func (a *rabbitAdmin) isAdministrator() (admin bool, err error) {
+	defer a.logCall("whoami", time.Now(), &err)
+
+	info, err := a.client.Whoami()
+	if err != nil {
+		return false, &rabbitAdminError{broker.ErrCodeOther, err}
+	}
+	for _, tag := range info.Tags {
+		if tag == "administrator" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Wraps an error returned by the management API client, reporting missing
+// entities as gone.
+func adminError(err error) error {
+	if isNotFound(err) {
+		return &rabbitAdminError{broker.ErrCodeGone, err}
+	}
+	return &rabbitAdminError{broker.ErrCodeOther, err}
+}
+
+func isNotFound(err error) bool {
+	switch err := err.(type) {
+	case rabbithole.ErrorResponse:
+		return err.StatusCode == http.StatusNotFound
+	case *rabbithole.ErrorResponse:
+		return err != nil && err.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
 func checkResponseAndClose(resp *http.Response) error {
 	defer resp.Body.Close()
 
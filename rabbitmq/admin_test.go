@@ -0,0 +1,37 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"errors"
+	"github.com/michaelklishin/rabbit-hole/v2"
+	"github.com/michaljemala/cf-service-broker/broker"
+	"net/http"
+	"testing"
+)
+
+func TestAdminErrors(t *testing.T) {
+	notFound := rabbithole.ErrorResponse{StatusCode: http.StatusNotFound, Message: "Object Not Found", Reason: "Not Found"}
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"not found", notFound, broker.ErrCodeGone},
+		{"not found pointer", &notFound, broker.ErrCodeGone},
+		{"server error", rabbithole.ErrorResponse{StatusCode: http.StatusInternalServerError}, broker.ErrCodeOther},
+		{"other error", errors.New("connection refused"), broker.ErrCodeOther},
+	}
+	for _, test := range tests {
+		err := adminError(test.err).(*rabbitAdminError)
+		if err.Code() != test.code {
+			t.Errorf("%v: expected code %v, got %v", test.name, test.code, err.Code())
+		}
+		// The message is shown to the users of the Cloud Controller
+		if err.Error() != test.err.Error() {
+			t.Errorf("%v: expected message %q, got %q", test.name, test.err.Error(), err.Error())
+		}
+	}
+}
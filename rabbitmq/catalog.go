@@ -0,0 +1,224 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaljemala/cf-service-broker/broker"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Key of the plan metadata holding the RabbitMQ specific plan settings, e.g.
+//
+//	metadata:
+//	  rabbitmq:
+//	    tracing: true
+const settingsKey = "rabbitmq"
+
+// The catalog exposed to the Cloud Controller together with the settings
+// of its plans.
+type catalog struct {
+	services broker.Catalog
+	plans    map[string]planSettings
+}
+
+func builtinCatalog() *catalog {
+	return &catalog{
+		services: broker.Catalog{
+			Services: []broker.Service{
+				broker.Service{
+					Id:                   "rabbitmq",
+					Name:                 "RabbitMQ",
+					Description:          "RabbitMQ Message Broker",
+					Bindable:             true,
+					Tags:                 []string{"rabbitmq", "messaging"},
+					PlanUpdateable:       true,
+					InstancesRetrievable: true,
+					BindingsRetrievable:  true,
+					Plans: []broker.Plan{
+						broker.Plan{
+							Id:          "simple",
+							Name:        "Simple RabbitMQ Plan",
+							Description: "Simple RabbitMQ plan represented as a unique broker's vhost.",
+						},
+						broker.Plan{
+							Id:          "traced",
+							Name:        "Traced RabbitMQ Plan",
+							Description: "Simple RabbitMQ plan with message tracing enabled in the broker's vhost.",
+						},
+					},
+				},
+			},
+		},
+		plans: map[string]planSettings{
+			"simple": planSettings{tracing: false},
+			"traced": planSettings{tracing: true},
+		},
+	}
+}
+
+// Loads the catalog from a JSON or YAML file, picked by the file extension.
+// The RabbitMQ specific settings are taken out of the plan metadata and
+// decoded strictly, while other fields unknown to the broker are ignored.
+func loadCatalog(file string) (*catalog, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yml", ".yaml":
+		if data, err = yamlToJson(data); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid catalog [%v]: %v", file, err))
+		}
+	}
+
+	var services broker.Catalog
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid catalog [%v]: %v", file, err))
+	}
+
+	c, err := newCatalog(services)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid catalog [%v]: %v", file, err))
+	}
+	return c, nil
+}
+
+// Validates the catalog and extracts the settings from its plans.
+func newCatalog(services broker.Catalog) (*catalog, error) {
+	if len(services.Services) == 0 {
+		return nil, errors.New("No services defined")
+	}
+
+	c := &catalog{plans: make(map[string]planSettings)}
+	serviceIds, planIds := make(map[string]bool), make(map[string]bool)
+	for _, s := range services.Services {
+		if s.Id == "" || s.Name == "" {
+			return nil, errors.New("Service without id or name")
+		}
+		if serviceIds[s.Id] {
+			return nil, errors.New(fmt.Sprintf("Duplicate service id: [%v]", s.Id))
+		}
+		serviceIds[s.Id] = true
+		if len(s.Plans) == 0 {
+			return nil, errors.New(fmt.Sprintf("No plans defined for service: [%v]", s.Id))
+		}
+
+		plans := make([]broker.Plan, 0, len(s.Plans))
+		for _, p := range s.Plans {
+			if p.Id == "" || p.Name == "" {
+				return nil, errors.New(fmt.Sprintf("Plan without id or name in service: [%v]", s.Id))
+			}
+			if planIds[p.Id] {
+				return nil, errors.New(fmt.Sprintf("Duplicate plan id: [%v]", p.Id))
+			}
+			planIds[p.Id] = true
+
+			settings, metadata, err := extractPlanSettings(p.Metadata)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid settings of plan [%v]: %v", p.Id, err))
+			}
+			c.plans[p.Id] = settings
+			p.Metadata = metadata
+			plans = append(plans, p)
+		}
+		s.Plans = plans
+		c.services.Services = append(c.services.Services, s)
+	}
+	return c, nil
+}
+
+// Splits the plan metadata into the RabbitMQ specific plan settings
+// and the metadata to expose in the catalog.
+func extractPlanSettings(metadata map[string]interface{}) (planSettings, map[string]interface{}, error) {
+	raw, found := metadata[settingsKey]
+	if !found {
+		return planSettings{}, metadata, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return planSettings{}, nil, err
+	}
+	var config struct {
+		Tracing bool `json:"tracing"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return planSettings{}, nil, err
+	}
+
+	exposed := make(map[string]interface{})
+	for k, v := range metadata {
+		if k != settingsKey {
+			exposed[k] = v
+		}
+	}
+	if len(exposed) == 0 {
+		exposed = nil
+	}
+	return planSettings{tracing: config.Tracing}, exposed, nil
+}
+
+func (c *catalog) planSettingsOf(planId string) (planSettings, error) {
+	settings, found := c.plans[planId]
+	if !found {
+		msg := fmt.Sprintf("Unknown plan: [%v]", planId)
+		return planSettings{}, &rabbitAdminError{broker.ErrCodeBadRequest, errors.New(msg)}
+	}
+	return settings, nil
+}
+
+// Converts a YAML document to JSON, so that it can be decoded
+// according to the JSON field names of the catalog.
+func yamlToJson(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	doc, err := jsonCompatible(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// YAML maps may have keys of any type, while JSON objects only allow strings.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Unsupported key: [%v]", key))
+			}
+			converted, err := jsonCompatible(value)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i, value := range v {
+			converted, err := jsonCompatible(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"github.com/michaljemala/cf-service-broker/broker"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeCatalog(t *testing.T, name, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write catalog: %v", err)
+	}
+	return file
+}
+
+const yamlCatalog = `
+services:
+- id: rabbitmq
+  name: RabbitMQ
+  description: RabbitMQ Message Broker
+  bindable: true
+  dashboard_client:
+    id: dashboard
+    secret: secret
+  unknown_service_field: ignored
+  plans:
+  - id: traced
+    name: Traced
+    description: Traced plan
+    free: false
+    bindable: true
+    plan_updateable: true
+    maintenance_info:
+      version: 1.0.0
+    metadata:
+      displayName: Traced
+      rabbitmq:
+        tracing: true
+`
+
+func TestLoadCatalogFromYaml(t *testing.T) {
+	c, err := loadCatalog(writeCatalog(t, "catalog.yml", yamlCatalog))
+	if err != nil {
+		t.Fatalf("Unable to load catalog: %v", err)
+	}
+
+	s := c.services.Services[0]
+	if s.DashboardClient == nil || s.DashboardClient.Id != "dashboard" {
+		t.Errorf("Expected the dashboard client to be loaded, got %+v", s.DashboardClient)
+	}
+	p := s.Plans[0]
+	if p.Free == nil || *p.Free || p.Bindable == nil || !*p.Bindable || p.PlanUpdateable == nil || !*p.PlanUpdateable {
+		t.Errorf("Expected the plan flags to be loaded, got free: %v, bindable: %v, plan_updateable: %v", p.Free, p.Bindable, p.PlanUpdateable)
+	}
+	if p.MaintenanceInfo == nil || p.MaintenanceInfo.Version != "1.0.0" {
+		t.Errorf("Expected the maintenance info to be loaded, got %+v", p.MaintenanceInfo)
+	}
+	if !reflect.DeepEqual(p.Metadata, map[string]interface{}{"displayName": "Traced"}) {
+		t.Errorf("Expected the RabbitMQ settings to be stripped from the metadata, got %v", p.Metadata)
+	}
+
+	settings, err := c.planSettingsOf("traced")
+	if err != nil || !settings.tracing {
+		t.Errorf("Expected tracing enabled for the traced plan, got %+v, %v", settings, err)
+	}
+}
+
+func TestLoadInvalidCatalog(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		expected string
+	}{
+		{"malformed JSON", "catalog.json", `{"services": [`, "Invalid catalog"},
+		{"malformed YAML", "catalog.yaml", "services: [", "Invalid catalog"},
+		{"no services", "catalog.json", `{"services": []}`, "No services defined"},
+		{"unknown setting", "catalog.json", `{"services": [{"id": "s", "name": "s", "plans": [{"id": "p", "name": "p", "metadata": {"rabbitmq": {"tracng": true}}}]}]}`, "Invalid settings of plan [p]"},
+	}
+	for _, test := range tests {
+		_, err := loadCatalog(writeCatalog(t, test.file, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected error containing %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestNewCatalogValidatesServicesAndPlans(t *testing.T) {
+	plan := func(id string) broker.Plan { return broker.Plan{Id: id, Name: id} }
+	tests := []struct {
+		name     string
+		services []broker.Service
+		expected string
+	}{
+		{"no services", nil, "No services defined"},
+		{"service without name", []broker.Service{{Id: "s", Plans: []broker.Plan{plan("p")}}}, "Service without id or name"},
+		{"no plans", []broker.Service{{Id: "s", Name: "s"}}, "No plans defined for service: [s]"},
+		{"plan without id", []broker.Service{{Id: "s", Name: "s", Plans: []broker.Plan{plan("")}}}, "Plan without id or name in service: [s]"},
+		{"duplicate service", []broker.Service{
+			{Id: "s", Name: "s", Plans: []broker.Plan{plan("p1")}},
+			{Id: "s", Name: "s", Plans: []broker.Plan{plan("p2")}},
+		}, "Duplicate service id: [s]"},
+		{"duplicate plan", []broker.Service{
+			{Id: "s1", Name: "s1", Plans: []broker.Plan{plan("p")}},
+			{Id: "s2", Name: "s2", Plans: []broker.Plan{plan("p")}},
+		}, "Duplicate plan id: [p]"},
+	}
+	for _, test := range tests {
+		_, err := newCatalog(broker.Catalog{Services: test.services})
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("%v: expected error %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestExtractPlanSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+		settings planSettings
+		exposed  map[string]interface{}
+		invalid  bool
+	}{
+		{"no metadata", nil, planSettings{}, nil, false},
+		{"no settings", map[string]interface{}{"bullets": "x"}, planSettings{}, map[string]interface{}{"bullets": "x"}, false},
+		{"settings only", map[string]interface{}{"rabbitmq": map[string]interface{}{"tracing": true}}, planSettings{tracing: true}, nil, false},
+		{"settings and metadata", map[string]interface{}{"rabbitmq": map[string]interface{}{}, "bullets": "x"}, planSettings{}, map[string]interface{}{"bullets": "x"}, false},
+		{"unknown setting", map[string]interface{}{"rabbitmq": map[string]interface{}{"tracng": true}}, planSettings{}, nil, true},
+		{"invalid setting", map[string]interface{}{"rabbitmq": map[string]interface{}{"tracing": "yes"}}, planSettings{}, nil, true},
+	}
+	for _, test := range tests {
+		settings, exposed, err := extractPlanSettings(test.metadata)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+		if settings != test.settings || !reflect.DeepEqual(exposed, test.exposed) {
+			t.Errorf("%v: expected %+v and %v, got %+v and %v", test.name, test.settings, test.exposed, settings, exposed)
+		}
+	}
+}
+
+func TestYamlToJson(t *testing.T) {
+	data, err := yamlToJson([]byte("a:\n  b: [1, {c: true}]\n  d: text\n"))
+	if err != nil {
+		t.Fatalf("Unable to convert: %v", err)
+	}
+	var doc, expected interface{}
+	json.Unmarshal(data, &doc)
+	json.Unmarshal([]byte(`{"a": {"b": [1, {"c": true}], "d": "text"}}`), &expected)
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("Expected %v, got %s", expected, data)
+	}
+
+	if _, err := yamlToJson([]byte("1: one\n")); err == nil {
+		t.Errorf("Expected non-string keys to be rejected")
+	}
+}
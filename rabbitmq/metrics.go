@@ -0,0 +1,38 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+var (
+	mgmtCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "management",
+		Name:      "call_duration_seconds",
+		Help:      "Latency of RabbitMQ management API calls by call.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call"})
+
+	mgmtCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rabbitmq",
+		Subsystem: "management",
+		Name:      "call_errors_total",
+		Help:      "Number of failed RabbitMQ management API calls by call.",
+	}, []string{"call"})
+)
+
+func init() {
+	prometheus.MustRegister(mgmtCallDuration, mgmtCallErrors)
+}
+
+func observeCall(call string, duration time.Duration, err error) {
+	mgmtCallDuration.WithLabelValues(call).Observe(duration.Seconds())
+	if err != nil {
+		mgmtCallErrors.WithLabelValues(call).Inc()
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/michaljemala/cf-service-broker/broker"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Period a finished operation is kept for if it is not polled.
+	operationRetention = time.Hour
+	// Interval to check whether the operations in progress finished on shutdown.
+	drainInterval = 100 * time.Millisecond
+)
+
+type operation struct {
+	name        string
+	state       broker.OperationState
+	description string
+	started     time.Time
+	finished    time.Time
+}
+
+// Keeps track of the asynchronous operations performed on each entity
+// until their outcome is polled.
+type operations struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	last    map[string]*operation
+}
+
+func newOperations(timeout time.Duration) *operations {
+	return &operations{timeout: timeout, last: make(map[string]*operation)}
+}
+
+// Runs the given function in background, recording its outcome
+// as the last operation of the specified entity. The function outlives
+// the request, so its context is only bounded by the operation timeout.
+// Fails if an operation is still in progress for the entity.
+func (o *operations) start(ctx context.Context, log *slog.Logger, key, name string, fn func(context.Context) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.expire()
+	if op, found := o.last[key]; found && op.state == broker.OperationInProgress {
+		msg := fmt.Sprintf("Operation in progress: [%v]", op.name)
+		return &rabbitAdminError{broker.ErrCodeConcurrency, errors.New(msg)}
+	}
+
+	op := &operation{name: name, state: broker.OperationInProgress, started: time.Now()}
+	o.last[key] = op
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), o.timeout)
+		defer cancel()
+
+		err := fn(ctx)
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if err != nil {
+			log.Error("Asynchronous operation failed", "async_operation", name, "error", err)
+			op.state, op.description = broker.OperationFailed, err.Error()
+		} else {
+			log.Info("Asynchronous operation succeeded", "async_operation", name)
+			op.state = broker.OperationSucceeded
+		}
+		op.finished = time.Now()
+	}()
+	return nil
+}
+
+// Returns the last operation of the entity, if still known. Finished
+// operations are forgotten once their outcome has been reported.
+func (o *operations) get(key string) (broker.LastOperation, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	op, found := o.last[key]
+	if !found {
+		return broker.LastOperation{}, false
+	}
+	if op.state != broker.OperationInProgress {
+		delete(o.last, key)
+	}
+	return broker.LastOperation{State: op.state, Description: op.description}, true
+}
+
+// Reports whether an operation is in progress for the instance or any of
+// its bindings.
+func (o *operations) busy(instanceId string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for key, op := range o.last {
+		if op.state == broker.OperationInProgress && (key == instanceId || strings.HasPrefix(key, instanceId+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *operations) forget(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.last, key)
+}
+
+// Drops the finished operations nobody polled within the retention period.
+func (o *operations) expire() {
+	for key, op := range o.last {
+		if op.state != broker.OperationInProgress && time.Since(op.finished) > operationRetention {
+			delete(o.last, key)
+		}
+	}
+}
+
+// Waits for the operations in progress to finish until the context is done.
+// Returns the descriptions of those still in progress.
+func (o *operations) drain(ctx context.Context) []string {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		pending := o.inProgress()
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *operations) inProgress() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var descs []string
+	for key, op := range o.last {
+		if op.state == broker.OperationInProgress {
+			descs = append(descs, fmt.Sprintf("%v [%v] (started at %v)", op.name, key, op.started.Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(descs)
+	return descs
+}
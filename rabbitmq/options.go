@@ -6,6 +6,7 @@ package rabbitmq
 
 import (
 	"flag"
+	"time"
 )
 
 var Opts Options = Options{}
@@ -15,14 +16,15 @@ func init() {
 }
 
 type Options struct {
-	Catalog  string
-	Host     string
-	Port     int
-	MgmtHost string
-	MgmtPort int
-	MgmtUser string
-	MgmtPass string
-	Trace    bool // TODO: Create Rabbit-Hole PR to enable such tracing
+	Catalog      string
+	Host         string
+	Port         int
+	MgmtHost     string
+	MgmtPort     int
+	MgmtUser     string
+	MgmtPass     string
+	AsyncTimeout time.Duration
+	Trace        bool // TODO: Create Rabbit-Hole PR to enable such tracing
 }
 
 func (o *Options) configure(fs *flag.FlagSet) {
@@ -47,17 +49,21 @@ func (o *Options) configure(fs *flag.FlagSet) {
 	fs.StringVar(&o.MgmtPass, "rmp", "guest", "")
 	fs.StringVar(&o.MgmtPass, "rabbit-mgmt-pass", "guest", "")
 
+	fs.DurationVar(&o.AsyncTimeout, "rat", 5*time.Minute, "")
+	fs.DurationVar(&o.AsyncTimeout, "rabbit-async-timeout", 5*time.Minute, "")
+
 	fs.BoolVar(&o.Trace, "R", false, "")
 }
 
 var UsageStr = `
 RabbitMQ Service Options:
-    -c,   --catalog CATALOG            A file to load the RabbitMQ broker's catalog from
+    -c,   --catalog CATALOG            JSON or YAML file to load the catalog from (reloaded on change or SIGHUP)
     -rh,  --rabbit-host HOST           Hostname of RabbitMQ server (default: 127.0.0.1)
     -rr,  --rabbit-port PORT           Port on which RabbitMQ server listens for messages  (default: 5672)
     -rmh, --rabbit-mgmt-host HOST      Hostname of RabbitMQ server (default: 127.0.0.1)
     -rmr, --rabbit-mgmt-port PORT      Port on which RabbitMQ server listens for management requests (default: 15672)
     -rmu, --rabbit-mgmt-user USERNAME  Username of the RabbitMQ server user with 'administrator' tag assigned (default: guest)
     -rmp, --rabbit-mgmt-pass PASSWORD  Password for the USERNAME user (default: guest)
+    -rat, --rabbit-async-timeout DUR   Deadline of the asynchronous operations (default: 5m)
     -R                                 Trace the outgoing RabbitMQ server management requests
 `
@@ -0,0 +1,34 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/michaelklishin/rabbit-hole/v2"
+	"github.com/michaljemala/cf-service-broker/broker"
+)
+
+// RabbitMQ specific settings applied to the vhost of a service instance.
+type planSettings struct {
+	tracing bool
+}
+
+// Builds the vhost settings of a plan, tagging the vhost with the organization
+// and space the service instance belongs to. Vhost descriptions and tags
+// require RabbitMQ 3.8 or later, older servers ignore them.
+func (ps planSettings) vhostSettings(ctx broker.PlatformContext) rabbithole.VhostSettings {
+	tags := []string{}
+	if ctx.OrgId != "" {
+		tags = append(tags, fmt.Sprintf("organization_guid:%v", ctx.OrgId))
+	}
+	if ctx.SpaceId != "" {
+		tags = append(tags, fmt.Sprintf("space_guid:%v", ctx.SpaceId))
+	}
+	return rabbithole.VhostSettings{
+		Description: ctx.InstanceName,
+		Tags:        tags,
+		Tracing:     ps.tracing,
+	}
+}
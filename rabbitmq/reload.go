@@ -0,0 +1,160 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"github.com/michaljemala/cf-service-broker/broker"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Interval to check the catalog file for changes at.
+var catalogCheckInterval = 5 * time.Second
+
+// Serves the catalog loaded from a file, or the built-in one if no file is
+// given. The file is re-read once it changes, or on SIGHUP, so plans can be
+// changed without restarting the broker. Invalid catalogs are rejected,
+// keeping the previous one in place.
+type catalogReloader struct {
+	file    string
+	watcher *broker.FileWatcher
+
+	mu      sync.RWMutex
+	current *catalog
+}
+
+func newCatalogReloader(file string) (*catalogReloader, error) {
+	r := &catalogReloader{file: file}
+	if file == "" {
+		r.current = builtinCatalog()
+		return r, nil
+	}
+	watcher, err := broker.NewFileWatcher(catalogCheckInterval, r.load, file)
+	if err != nil {
+		return nil, err
+	}
+	r.watcher = watcher
+	return r, nil
+}
+
+// Returns the current catalog, reloading it first if the file has changed.
+func (r *catalogReloader) get() *catalog {
+	if r.watcher != nil {
+		if err := r.watcher.Check(); err != nil {
+			slog.Warn("Keeping previous catalog", "component", "catalog", "file", r.file, "error", err)
+		}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// Loads the catalog from the file and swaps it in if valid.
+func (r *catalogReloader) load() error {
+	log := slog.Default().With("component", "catalog", "file", r.file)
+
+	c, err := loadCatalog(r.file)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	previous := r.current
+	r.current = c
+	r.mu.Unlock()
+
+	if previous == nil {
+		log.Info("Catalog loaded")
+		return nil
+	}
+	changes := diffCatalogs(previous, c)
+	for _, change := range changes {
+		log.Info("Catalog changed", change...)
+	}
+	log.Info("Catalog reloaded", "changes", len(changes))
+	return nil
+}
+
+// Reloads the catalog file regardless of its modification time.
+func (r *catalogReloader) reload() error {
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Reload()
+}
+
+// Lists the services and plans added, removed or changed, each as
+// the attributes of a log entry.
+func diffCatalogs(old, new *catalog) [][]interface{} {
+	var changes [][]interface{}
+
+	oldServices := make(map[string]int)
+	for i, s := range old.services.Services {
+		oldServices[s.Id] = i
+	}
+	newServices := make(map[string]bool)
+
+	for _, s := range new.services.Services {
+		newServices[s.Id] = true
+		i, found := oldServices[s.Id]
+		if !found {
+			changes = append(changes, []interface{}{"change", "added", "service_id", s.Id})
+			for _, p := range s.Plans {
+				changes = append(changes, []interface{}{"change", "added", "service_id", s.Id, "plan_id", p.Id})
+			}
+			continue
+		}
+
+		o := old.services.Services[i]
+		oldPlans := make(map[string]int)
+		for j, p := range o.Plans {
+			oldPlans[p.Id] = j
+		}
+		newPlans := make(map[string]bool)
+		for _, p := range s.Plans {
+			newPlans[p.Id] = true
+			j, found := oldPlans[p.Id]
+			switch {
+			case !found:
+				changes = append(changes, []interface{}{"change", "added", "service_id", s.Id, "plan_id", p.Id})
+			case !sameJson(o.Plans[j], p) || old.plans[p.Id] != new.plans[p.Id]:
+				changes = append(changes, []interface{}{"change", "changed", "service_id", s.Id, "plan_id", p.Id})
+			}
+		}
+		for _, p := range o.Plans {
+			if !newPlans[p.Id] {
+				changes = append(changes, []interface{}{"change", "removed", "service_id", s.Id, "plan_id", p.Id})
+			}
+		}
+
+		o.Plans, s.Plans = nil, nil
+		if !sameJson(o, s) {
+			changes = append(changes, []interface{}{"change", "changed", "service_id", s.Id})
+		}
+	}
+
+	for _, s := range old.services.Services {
+		if !newServices[s.Id] {
+			changes = append(changes, []interface{}{"change", "removed", "service_id", s.Id})
+		}
+	}
+	return changes
+}
+
+// Compares the values as they are exposed to the Cloud Controller.
+func sameJson(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	var va, vb interface{}
+	json.Unmarshal(ja, &va)
+	json.Unmarshal(jb, &vb)
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,108 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const jsonCatalog = `{"services": [
+	{"id": "s1", "name": "s1", "description": "%v", "plans": [
+		{"id": "p1", "name": "p1", "metadata": {"rabbitmq": {"tracing": %v}}},
+		{"id": "%v", "name": "%v"}
+	]},
+	{"id": "%v", "name": "%v", "plans": [{"id": "p3", "name": "p3"}]}
+]}`
+
+func mustLoadCatalog(t *testing.T, content string) *catalog {
+	t.Helper()
+	c, err := loadCatalog(writeCatalog(t, "catalog.json", content))
+	if err != nil {
+		t.Fatalf("Unable to load catalog: %v", err)
+	}
+	return c
+}
+
+func TestDiffCatalogs(t *testing.T) {
+	old := mustLoadCatalog(t, fmt.Sprintf(jsonCatalog, "Service", false, "p2", "p2", "s2", "s2"))
+
+	tests := []struct {
+		name     string
+		content  string
+		expected [][]interface{}
+	}{
+		{"unchanged", fmt.Sprintf(jsonCatalog, "Service", false, "p2", "p2", "s2", "s2"), nil},
+		{"service changed", fmt.Sprintf(jsonCatalog, "Changed", false, "p2", "p2", "s2", "s2"), [][]interface{}{
+			{"change", "changed", "service_id", "s1"},
+		}},
+		{"settings changed", fmt.Sprintf(jsonCatalog, "Service", true, "p2", "p2", "s2", "s2"), [][]interface{}{
+			{"change", "changed", "service_id", "s1", "plan_id", "p1"},
+		}},
+		{"plan replaced", fmt.Sprintf(jsonCatalog, "Service", false, "p4", "p4", "s2", "s2"), [][]interface{}{
+			{"change", "added", "service_id", "s1", "plan_id", "p4"},
+			{"change", "removed", "service_id", "s1", "plan_id", "p2"},
+		}},
+		{"service replaced", fmt.Sprintf(jsonCatalog, "Service", false, "p2", "p2", "s3", "s3"), [][]interface{}{
+			{"change", "added", "service_id", "s3"},
+			{"change", "added", "service_id", "s3", "plan_id", "p3"},
+			{"change", "removed", "service_id", "s2"},
+		}},
+	}
+	for _, test := range tests {
+		changes := diffCatalogs(old, mustLoadCatalog(t, test.content))
+		if !reflect.DeepEqual(changes, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, changes)
+		}
+	}
+}
+
+func TestReloaderKeepsPreviousCatalogWhenInvalid(t *testing.T) {
+	defer func(interval time.Duration) { catalogCheckInterval = interval }(catalogCheckInterval)
+	catalogCheckInterval = 0
+
+	file := writeCatalog(t, "catalog.json", fmt.Sprintf(jsonCatalog, "Service", false, "p2", "p2", "s2", "s2"))
+	r, err := newCatalogReloader(file)
+	if err != nil {
+		t.Fatalf("Unable to load catalog: %v", err)
+	}
+	loaded := r.get()
+
+	modified := time.Now().Add(time.Minute)
+	if err := os.WriteFile(file, []byte(`{"services": []}`), 0600); err != nil {
+		t.Fatalf("Unable to write catalog: %v", err)
+	}
+	os.Chtimes(file, modified, modified)
+	if c := r.get(); c != loaded {
+		t.Errorf("Expected the previous catalog to be kept, got %+v", c.services)
+	}
+	if err := r.reload(); err == nil || r.get() != loaded {
+		t.Errorf("Expected the invalid catalog to be rejected when reloaded")
+	}
+
+	// A valid file replaces the catalog
+	modified = modified.Add(time.Minute)
+	if err := os.WriteFile(file, []byte(fmt.Sprintf(jsonCatalog, "Service", false, "p2", "p2", "s3", "s3")), 0600); err != nil {
+		t.Fatalf("Unable to write catalog: %v", err)
+	}
+	os.Chtimes(file, modified, modified)
+	if c := r.get(); c == loaded || c.services.Services[1].Id != "s3" {
+		t.Errorf("Expected the changed catalog to be loaded, got %+v", c.services)
+	}
+}
+
+func TestBuiltinCatalogIsNotReloaded(t *testing.T) {
+	r, err := newCatalogReloader("")
+	if err != nil {
+		t.Fatalf("Unable to load catalog: %v", err)
+	}
+	loaded := r.get()
+	if err := r.reload(); err != nil || r.get() != loaded {
+		t.Errorf("Expected the built-in catalog to be kept, got %v", err)
+	}
+}
@@ -5,15 +5,26 @@
 package rabbitmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/michaelklishin/rabbit-hole/v2"
 	"github.com/michaljemala/cf-service-broker/broker"
-	"log"
+	"log/slog"
+	"sync"
+	"time"
 )
 
+// Time given to undo a partially completed operation.
+const rollbackTimeout = 30 * time.Second
+
 // BrokerService implementation for RabbitMQ Server
 type rabbitService struct {
-	opts  Options
-	admin *rabbitAdmin
+	opts     Options
+	catalog  *catalogReloader
+	admin    *rabbitAdmin
+	ops      *operations
+	bindings *bindings
 }
 
 func New(opts Options) (*rabbitService, error) {
@@ -22,112 +33,394 @@ func New(opts Options) (*rabbitService, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &rabbitService{opts, adm}, nil
-}
-
-func (b *rabbitService) Catalog() (broker.Catalog, error) {
-	// TODO: Maybe read catalog from a file
-	return broker.Catalog{
-		Services: []broker.Service{
-			broker.Service{
-				Id:          "rabbitmq",
-				Name:        "RabbitMQ",
-				Description: "RabbitMQ Message Broker",
-				Bindable:    true,
-				Tags:        []string{"rabbitmq", "messaging"},
-				Plans: []broker.Plan{
-					broker.Plan{
-						Id:          "simple",
-						Name:        "Simple RabbitMQ Plan",
-						Description: "Simple RabbitMQ plan represented as a unique broker's vhost.",
-					},
-				},
-			},
-		},
-	}, nil
-}
-
-func (b *rabbitService) Provision(pr broker.ProvisioningRequest) (string, error) {
-	vhost := pr.InstanceId
-	if err := b.admin.createVhost(vhost, false); err != nil {
-		return "", err
+	cat, err := newCatalogReloader(opts.Catalog)
+	if err != nil {
+		return nil, err
 	}
-	log.Printf("Service: Virtual host created: [%v]", vhost)
+	return &rabbitService{opts, cat, adm, newOperations(opts.AsyncTimeout), newBindings()}, nil
+}
 
+func (b *rabbitService) Catalog(ctx context.Context) (broker.Catalog, error) {
+	return b.catalog.get().services, nil
+}
+
+func (b *rabbitService) Provision(ctx context.Context, pr broker.ProvisioningRequest) (broker.ProvisioningResponse, error) {
+	log := pr.Log().With("component", "service")
+
+	plan, err := b.catalog.get().planSettingsOf(pr.PlanId)
+	if err != nil {
+		return broker.ProvisioningResponse{}, err
+	}
+	settings := plan.vhostSettings(pr.Context)
+	log.Info("Provisioning requested", "plan_id", pr.PlanId, "identity", pr.Identity.String())
+
+	vhost := pr.InstanceId
 	username := fmt.Sprintf("m-%v", vhost)
 	password, _ := broker.RandomPasswordGenerator.GeneratePassword()
-	if err := b.admin.createUser(username, password); err != nil {
-		b.admin.deleteVhost(vhost)
-		return "", err
+
+	dashboardUrl := b.dashboardUrl(username, password)
+	log.Debug("Dasboard URL generated", "url", b.dashboardUrl(username, broker.Redacted))
+
+	if pr.AcceptsIncomplete {
+		err := b.ops.start(ctx, log, vhost, "provision", func(ctx context.Context) error {
+			return b.provision(ctx, log, vhost, username, password, settings)
+		})
+		if err != nil {
+			return broker.ProvisioningResponse{}, err
+		}
+		log.Info("Provisioning started", "vhost", vhost)
+
+		return broker.ProvisioningResponse{DashboardUrl: dashboardUrl, Operation: "provision", Async: true}, nil
 	}
-	log.Printf("Service: Management user created: [%v]", username)
 
-	if err := b.admin.grantAllPermissionsIn(username, vhost); err != nil {
-		b.admin.deleteUser(username)
-		b.admin.deleteVhost(vhost)
-		return "", err
+	if err := b.provision(ctx, log, vhost, username, password, settings); err != nil {
+		return broker.ProvisioningResponse{}, err
 	}
-	log.Printf("Service: All permissions granted to management user: [%v]", username)
+	return broker.ProvisioningResponse{DashboardUrl: dashboardUrl}, nil
+}
 
-	dashboardUrl := fmt.Sprintf("http://%v:%v/#/login/%v/%v", b.opts.Host, b.opts.MgmtPort, username, password)
-	log.Printf("Service: Dasboard URL generated: [%v]", dashboardUrl)
+func (b *rabbitService) provision(ctx context.Context, log *slog.Logger, vhost, username, password string, settings rabbithole.VhostSettings) error {
+	admin, err := b.admin.withContext(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	if err := admin.createVhost(vhost, settings); err != nil {
+		return err
+	}
+	log.Info("Virtual host created", "vhost", vhost)
+
+	if err := admin.createUser(username, password); err != nil {
+		b.rollback(ctx, log, func(admin *rabbitAdmin) {
+			admin.deleteVhost(vhost)
+		})
+		return err
+	}
+	log.Info("Management user created", "user", username)
 
-	return dashboardUrl, nil
+	if err := admin.grantAllPermissionsIn(username, vhost); err != nil {
+		b.rollback(ctx, log, func(admin *rabbitAdmin) {
+			admin.deleteUser(username)
+			admin.deleteVhost(vhost)
+		})
+		return err
+	}
+	log.Info("All permissions granted to management user", "user", username, "vhost", vhost)
+
+	return nil
 }
 
-func (b *rabbitService) Deprovision(pr broker.ProvisioningRequest) error {
+// Undoes a partially completed operation. The rollback gets a deadline of
+// its own, since the one of the operation may be what made it fail.
+func (b *rabbitService) rollback(ctx context.Context, log *slog.Logger, fn func(*rabbitAdmin)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	admin, err := b.admin.withContext(ctx, log)
+	if err != nil {
+		log.Error("Rollback failed", "error", err)
+		return
+	}
+	fn(admin)
+}
+
+func (b *rabbitService) Update(ctx context.Context, ur broker.UpdateRequest) (broker.OperationResponse, error) {
+	log := ur.Log().With("component", "service")
+
+	plan, err := b.catalog.get().planSettingsOf(ur.PlanId)
+	if err != nil {
+		return broker.OperationResponse{}, err
+	}
+	log.Info("Update requested", "plan_id", ur.PlanId, "identity", ur.Identity.String())
+
+	admin, err := b.admin.withContext(ctx, log)
+	if err != nil {
+		return broker.OperationResponse{}, err
+	}
+
+	vhost := ur.InstanceId
+	if err := admin.updateVhost(vhost, plan.vhostSettings(ur.Context)); err != nil {
+		return broker.OperationResponse{}, err
+	}
+	log.Info("Virtual host updated", "vhost", vhost, "previous_plan_id", ur.PreviousValues.PlanId, "plan_id", ur.PlanId)
+
+	return broker.OperationResponse{}, nil
+}
+
+func (b *rabbitService) LastOperation(ctx context.Context, lr broker.LastOperationRequest) (broker.LastOperation, error) {
+	if op, found := b.ops.get(lr.InstanceId); found {
+		return op, nil
+	}
+	return b.recoverOperation(ctx, lr)
+}
+
+func (b *rabbitService) Deprovision(ctx context.Context, pr broker.ProvisioningRequest) error {
+	log := pr.Log().With("component", "service")
+	admin, err := b.admin.withContext(ctx, log)
+	if err != nil {
+		return err
+	}
+
 	vhost := pr.InstanceId
+	if b.ops.busy(vhost) {
+		msg := fmt.Sprintf("Operation in progress for instance: [%v]", vhost)
+		return &rabbitAdminError{broker.ErrCodeConcurrency, errors.New(msg)}
+	}
+	b.ops.forget(vhost)
+	log.Info("Deprovisioning requested", "plan_id", pr.PlanId, "identity", pr.Identity.String())
+
 	username := fmt.Sprintf("m-%v", vhost)
-	if err := b.admin.deleteUser(username); err != nil {
+	if err := admin.deleteUser(username); err != nil {
 		return err
 	}
-	log.Printf("Service: Management user deleted: [%v]", username)
+	log.Info("Management user deleted", "user", username)
 
 	//TODO:Should close existing connections from user 'username'???
 
-	if err := b.admin.deleteVhost(vhost); err != nil {
+	if err := admin.deleteVhost(vhost); err != nil {
 		return err
 	}
-	log.Printf("Service: Virtual host deleted: [%v]", vhost)
+	log.Info("Virtual host deleted", "vhost", vhost)
 
 	return nil
 }
 
-func (b *rabbitService) Bind(br broker.BindingRequest) (broker.Credentials, string, error) {
+func (b *rabbitService) Bind(ctx context.Context, br broker.BindingRequest) (broker.BindingResponse, error) {
+	log := br.Log().With("component", "service")
+
 	vhost := br.InstanceId
+	key := bindingKey(br.InstanceId, br.BindingId)
+	log.Info("Binding requested", "identity", br.Identity.String())
 
-	username := fmt.Sprintf("u-%v", vhost)
+	username := bindingUser(vhost, br.BindingId)
 	password, _ := broker.RandomPasswordGenerator.GeneratePassword()
-	if err := b.admin.createUser(username, password); err != nil {
-		return nil, "", err
+
+	amqpUrl := b.amqpUrl(username, password, vhost)
+	log.Debug("AMQP URL generated", "url", b.amqpUrl(username, broker.Redacted, vhost))
+	cred := broker.Credentials{"uri": amqpUrl}
+
+	if br.AcceptsIncomplete {
+		err := b.ops.start(ctx, log, key, "bind", func(ctx context.Context) error {
+			if err := b.bind(ctx, log, vhost, username, password); err != nil {
+				return err
+			}
+			b.bindings.put(key, cred)
+			return nil
+		})
+		if err != nil {
+			return broker.BindingResponse{}, err
+		}
+		log.Info("Binding started")
+
+		return broker.BindingResponse{Operation: "bind", Async: true}, nil
+	}
+
+	if err := b.bind(ctx, log, vhost, username, password); err != nil {
+		return broker.BindingResponse{}, err
+	}
+	b.bindings.put(key, cred)
+
+	return broker.BindingResponse{Credentials: cred}, nil
+}
+
+func (b *rabbitService) bind(ctx context.Context, log *slog.Logger, vhost, username, password string) error {
+	admin, err := b.admin.withContext(ctx, log)
+	if err != nil {
+		return err
 	}
-	log.Printf("Service: User created: [%v]", username)
 
-	if err := b.admin.grantAllPermissionsIn(username, vhost); err != nil {
-		b.admin.deleteUser(username)
-		return nil, "", err
+	if err := admin.createUser(username, password); err != nil {
+		return err
 	}
-	log.Printf("Service: All permissions granted for vhost: [%v] to user: [%v]", vhost, username)
+	log.Info("User created", "user", username)
 
-	amqpUrl := fmt.Sprintf("amqp://%v:%v@%v:%v/%v", username, password, b.opts.Host, b.opts.Port, vhost)
-	log.Printf("Service: AMQP URL generated: [%v]", amqpUrl)
+	if err := admin.grantAllPermissionsIn(username, vhost); err != nil {
+		b.rollback(ctx, log, func(admin *rabbitAdmin) {
+			admin.deleteUser(username)
+		})
+		return err
+	}
+	log.Info("All permissions granted to user", "user", username, "vhost", vhost)
 
-	return broker.Credentials{"uri": amqpUrl}, "", nil
+	return nil
 }
 
-func (b *rabbitService) Unbind(br broker.BindingRequest) error {
+func (b *rabbitService) FetchBinding(ctx context.Context, br broker.BindingRequest) (broker.BindingResponse, error) {
+	key := bindingKey(br.InstanceId, br.BindingId)
+	cred, found := b.bindings.get(key)
+	if !found {
+		msg := fmt.Sprintf("Binding not found: [%v]", key)
+		return broker.BindingResponse{}, &rabbitAdminError{broker.ErrCodeNotFound, errors.New(msg)}
+	}
+	return broker.BindingResponse{Credentials: cred}, nil
+}
+
+func (b *rabbitService) LastBindingOperation(ctx context.Context, lr broker.LastOperationRequest) (broker.LastOperation, error) {
+	if op, found := b.ops.get(bindingKey(lr.InstanceId, lr.BindingId)); found {
+		return op, nil
+	}
+	return b.recoverOperation(ctx, lr)
+}
+
+// Determines the outcome of an operation no longer tracked, e.g. due to
+// a restart, from the entities present in the management API. Operations
+// that cannot be determined are reported as gone.
+func (b *rabbitService) recoverOperation(ctx context.Context, lr broker.LastOperationRequest) (broker.LastOperation, error) {
+	log := lr.Log().With("component", "service")
+	admin, err := b.admin.withContext(ctx, log)
+	if err != nil {
+		return broker.LastOperation{}, err
+	}
+
+	vhost := lr.InstanceId
+	var succeeded bool
+	switch lr.Operation {
+	case "provision":
+		succeeded, err = admin.isVhost(vhost)
+		if err == nil && succeeded {
+			succeeded, err = admin.isUser(fmt.Sprintf("m-%v", vhost))
+		}
+	case "bind":
+		// The credentials do not survive a restart, so the binding is unusable
+		_, succeeded = b.bindings.get(bindingKey(lr.InstanceId, lr.BindingId))
+	case "unbind":
+		var found bool
+		found, err = admin.isUser(bindingUser(vhost, lr.BindingId))
+		succeeded = !found
+	default:
+		key := lr.InstanceId
+		if lr.BindingId != "" {
+			key = bindingKey(lr.InstanceId, lr.BindingId)
+		}
+		msg := fmt.Sprintf("No operation found for: [%v]", key)
+		return broker.LastOperation{}, &rabbitAdminError{broker.ErrCodeGone, errors.New(msg)}
+	}
+	if err != nil {
+		return broker.LastOperation{}, err
+	}
+
+	log.Warn("Operation no longer tracked, outcome recovered", "async_operation", lr.Operation, "succeeded", succeeded)
+	if succeeded {
+		return broker.LastOperation{State: broker.OperationSucceeded}, nil
+	}
+	return broker.LastOperation{State: broker.OperationFailed, Description: "Operation interrupted"}, nil
+}
+
+func (b *rabbitService) Unbind(ctx context.Context, br broker.BindingRequest) (broker.OperationResponse, error) {
+	log := br.Log().With("component", "service")
+
 	vhost := br.InstanceId
-	username := fmt.Sprintf("u-%v", vhost)
+	key := bindingKey(br.InstanceId, br.BindingId)
+	username := bindingUser(vhost, br.BindingId)
+	log.Info("Unbinding requested", "identity", br.Identity.String())
+
+	if br.AcceptsIncomplete {
+		err := b.ops.start(ctx, log, key, "unbind", func(ctx context.Context) error {
+			return b.unbind(ctx, log, key, username)
+		})
+		if err != nil {
+			return broker.OperationResponse{}, err
+		}
+		log.Info("Unbinding started")
+
+		return broker.OperationResponse{Operation: "unbind", Async: true}, nil
+	}
 
-	log.Printf("Service: Deleting user: [%v]", username)
+	return broker.OperationResponse{}, b.unbind(ctx, log, key, username)
+}
+
+func (b *rabbitService) unbind(ctx context.Context, log *slog.Logger, key, username string) error {
+	log.Info("Deleting user", "user", username)
 
-	err := b.admin.deleteUser(username)
+	admin, err := b.admin.withContext(ctx, log)
 	if err != nil {
 		return err
 	}
-	log.Printf("Service: User deleted: [%v]", username)
+	if err := admin.deleteUser(username); err != nil {
+		return err
+	}
+	log.Info("User deleted", "user", username)
 
 	//TODO:Should close existing connections from user 'username'???
 
+	b.bindings.remove(key)
+
 	return nil
 }
+
+func (b *rabbitService) CheckHealth(ctx context.Context) error {
+	admin, err := b.admin.withContext(ctx, slog.Default())
+	if err != nil {
+		return err
+	}
+
+	if err := admin.overview(); err != nil {
+		return err
+	}
+	isAdmin, err := admin.isAdministrator()
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		msg := fmt.Sprintf("Management user is not an administrator: [%v]", b.opts.MgmtUser)
+		return &rabbitAdminError{broker.ErrCodeServiceUnavailable, errors.New(msg)}
+	}
+	return nil
+}
+
+// Re-reads the catalog file, if any, on SIGHUP.
+func (b *rabbitService) Reload(ctx context.Context) error {
+	return b.catalog.reload()
+}
+
+// Waits for the asynchronous operations in progress on shutdown.
+func (b *rabbitService) Drain(ctx context.Context) []string {
+	return b.ops.drain(ctx)
+}
+
+func (b *rabbitService) dashboardUrl(username, password string) string {
+	return fmt.Sprintf("http://%v:%v/#/login/%v/%v", b.opts.Host, b.opts.MgmtPort, username, password)
+}
+
+func (b *rabbitService) amqpUrl(username, password, vhost string) string {
+	return fmt.Sprintf("amqp://%v:%v@%v:%v/%v", username, password, b.opts.Host, b.opts.Port, vhost)
+}
+
+// Each binding gets its own user, so unbinding revokes its credentials only.
+func bindingUser(vhost, bindingId string) string {
+	return fmt.Sprintf("u-%v-%v", vhost, bindingId)
+}
+
+func bindingKey(instanceId, bindingId string) string {
+	return fmt.Sprintf("%v/%v", instanceId, bindingId)
+}
+
+// Keeps the credentials of created bindings, so they can be fetched
+// once an asynchronous binding completes.
+type bindings struct {
+	mu    sync.Mutex
+	creds map[string]broker.Credentials
+}
+
+func newBindings() *bindings {
+	return &bindings{creds: make(map[string]broker.Credentials)}
+}
+
+func (s *bindings) put(key string, cred broker.Credentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds[key] = cred
+}
+
+func (s *bindings) get(key string) (broker.Credentials, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cred, found := s.creds[key]
+	return cred, found
+}
+
+func (s *bindings) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.creds, key)
+}